@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
@@ -34,9 +35,80 @@ func main() {
 	noRofi := flag.Bool("no-rofi", false, "No rofi")
 	updateScript := flag.Bool("u", false, "Update the script")
 	editConfig := flag.Bool("e", false, "Edit configuration file")
+	dlna := flag.Bool("dlna", false, "Share the current stream and watch history with TVs on the local network (DLNA/UPnP)")
+	hls := flag.Bool("hls", false, "Transcode the stream to HLS for browsers and weak devices instead of opening mpv")
+	var hlsOptions internal.HlsOptions
+	flag.StringVar(&hlsOptions.Quality, "hls-quality", "720p", "HLS quality (1080p/720p/480p/360p/source)")
+	flag.IntVar(&hlsOptions.AudioTrack, "hls-audio", 0, "Audio track of the video to use for HLS")
+	flag.IntVar(&hlsOptions.SubtitleTrack, "hls-burn-subs", -1, "Subtitle track of the video to burn into HLS (-1 for none)")
+	hlsInput := flag.String("hls-input", "", "Transcode a local file or URL to HLS without searching for torrents")
+	serveOnly := flag.Bool("serve", false, "Only serve the stream and print its URL instead of opening mpv")
+	serveJSON := flag.Bool("serve-json", false, "Print the served stream details as JSON")
+	serveOutput := flag.String("serve-output", "", "Also write the served stream URL (or JSON) to this file")
+	serveTrack := flag.Bool("serve-track", false, "Track progress of served streams in the watch history")
+	flag.StringVar(&config.Player, "player", config.Player, "Player to open streams in (mpv/vlc/generic)")
+	clearSkipSegments := flag.Bool("clear-skip-segments", false, "Forget the intro/outro segments recorded for the selected show")
+	skipChapters := flag.String("skip-chapters", "", "Set opening/ending chapter skipping for the selected show (auto/prompt/off)")
+	partyHost := flag.String("party-host", "", "Host a watch party, accepting guests on this address (e.g. :7000)")
+	partyVia := flag.String("party-via", "", "Host a watch party through the relay at this address")
+	partyJoin := flag.String("party-join", "", "Join the watch party hosted or relayed at this address")
+	flag.BoolVar(&config.MpvPlaylist, "playlist", config.MpvPlaylist, "Load all episodes into mpv as a playlist instead of restarting it for each one")
+	stopAfter := flag.Int("stop-after", 0, "Stop after watching this many episodes")
+	sleepAfter := flag.Duration("sleep", 0, "Stop playback after this long, e.g. 45m or 1h30m")
+	stopAtSeasonEnd := flag.Bool("stop-at-season-end", false, "Stop at the end of the current season")
+	partyRelay := flag.String("party-relay", "", "Only relay a watch party between its host and guests on this address")
+	flag.StringVar(&config.WatchPartySecret, "party-secret", config.WatchPartySecret, "Secret that watch party hosts and guests need to connect")
 	flag.Parse()
 
 	internal.InitLogger(*debug)
+	internal.SetGlobalConfig(&config)
+
+	databaseFile := filepath.Join(os.ExpandEnv(config.StoragePath), "buttercup.db")
+
+	switch flag.Arg(0) {
+	case "history":
+		if err := internal.RunHistoryCommand(databaseFile, flag.Args()[1:]); err != nil {
+			internal.Exit("History command failed", err)
+		}
+		return
+	case "anilist":
+		if err := internal.RunAnilistCommand(databaseFile, flag.Args()[1:]); err != nil {
+			internal.Exit("AniList command failed", err)
+		}
+		return
+	case "trakt":
+		if err := internal.RunTraktCommand(flag.Args()[1:]); err != nil {
+			internal.Exit("Trakt command failed", err)
+		}
+		return
+	}
+
+	// Set up signal handling
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		internal.Cleanup()
+		os.Exit(0)
+	}()
+
+	if *hlsInput != "" {
+		serveHls(*hlsInput, hlsOptions)
+	}
+
+	// Without a secret anyone who finds the port could join or take over the party
+	if (*partyRelay != "" || *partyHost != "" || *partyVia != "" || *partyJoin != "") && config.WatchPartySecret == "" {
+		internal.Exit("Watch parties need a secret, set WatchPartySecret in the config or pass -party-secret", nil)
+	}
+
+	if *partyRelay != "" {
+		hub, err := internal.StartPartyHub(*partyRelay, config.WatchPartySecret, true)
+		if err != nil {
+			internal.Exit("Failed to start watch party relay", err)
+		}
+		internal.Info("Relaying watch party on %s, press Ctrl+C to stop", hub.Addr())
+		select {}
+	}
 
 	if *updateScript {
 		repo := "wraient/buttercup"
@@ -62,6 +134,23 @@ func main() {
 		return
 	}
 
+	// Catch a broken player setup before searching, unless the stream is only served
+	if !*hls && !*serveOnly {
+		if err := internal.ValidatePlayerConfig(&config); err != nil {
+			internal.Exit("Invalid player configuration", err)
+		}
+	}
+	if err := internal.ValidateChapterSkipConfig(&config); err != nil {
+		internal.Exit("Invalid chapter skip configuration", err)
+	}
+	if *skipChapters != "" && !internal.ValidChapterSkipMode(*skipChapters) {
+		internal.Exit(fmt.Sprintf("Invalid -skip-chapters value %q, expected auto, prompt or off", *skipChapters), nil)
+	}
+	if *stopAfter < 0 || *sleepAfter < 0 {
+		internal.Exit("-stop-after and -sleep can't be negative", nil)
+	}
+	limits := internal.NewSessionLimits(*stopAfter, *sleepAfter, *stopAtSeasonEnd)
+
 	if *rofiSelection {
 		config.RofiSelection = true
 	}
@@ -85,14 +174,14 @@ func main() {
 		}
 	}
 
-	// Check if Jackett is available
-	if err := internal.CheckJackettAvailability(&config); err != nil {
+	// Check if Jackett is available, guests get the torrent from the host instead
+	if err := internal.CheckJackettAvailability(&config); err != nil && *partyJoin == "" {
 		internal.Debug("Jackett not available")
 		if config.RunJackettAtStartup {
 			internal.Info("Starting Jackett service...")
 			err := internal.StartJackett()
 			if err != nil {
-				internal.Info("Failed to start Jackett", err)
+				internal.Info("Failed to start Jackett: %v", err)
 			}
 		}
 
@@ -176,7 +265,7 @@ func main() {
 		}
 	}
 
-	if config.RunJackettAtStartup {
+	if config.RunJackettAtStartup && *partyJoin == "" {
 		// Get Jackett API key and store it in config
 		if config.JackettApiKey == "" {
 			internal.Info("Getting Jackett API key...")
@@ -201,20 +290,66 @@ func main() {
 	internal.Debug("Config loaded successfully: %+v", config)
 
 	// Load animes in database
-	databaseFile := filepath.Join(os.ExpandEnv(config.StoragePath), "torrent_history.txt")
 	databaseTorrents := internal.LocalGetAllTorrents(databaseFile)
 
 	defer internal.CleanupWebtorrent() // Keep this as a backup
 
+	if *dlna {
+		server, err := internal.StartDlnaServer(databaseFile)
+		if err != nil {
+			internal.Exit("Failed to start DLNA server", err)
+		}
+		internal.Info("Sharing on the local network as \"%s\"", server.Name)
+	}
+
 	// Add initial menu options
 	initialOptions := map[string]string{
 		"1": "Start New Show",
 		"2": "Continue Watching",
 	}
+	if *dlna {
+		initialOptions["3"] = "Share Watch History over DLNA only"
+	}
 
-	initialSelection, err := internal.DynamicSelect(initialOptions)
-	if err != nil {
-		internal.Exit("Error showing initial menu", err)
+	var party internal.PartyPublisher
+	var guest *internal.PartyGuest
+	var partyEpisode internal.PartyMessage
+	switch {
+	case *partyHost != "":
+		hub, err := internal.StartPartyHub(*partyHost, config.WatchPartySecret, false)
+		if err != nil {
+			internal.Exit("Failed to host watch party", err)
+		}
+		internal.Info("Hosting a watch party on %s", hub.Addr())
+		party = hub
+	case *partyVia != "":
+		relay, err := internal.ConnectPartyRelay(*partyVia, config.WatchPartySecret)
+		if err != nil {
+			internal.Exit("Failed to host watch party", err)
+		}
+		internal.Info("Hosting a watch party through %s", *partyVia)
+		party = relay
+	case *partyJoin != "":
+		guest, err = internal.JoinWatchParty(*partyJoin, config.WatchPartySecret, float64(config.WatchPartyTolerance))
+		if err != nil {
+			internal.Exit("Failed to join watch party", err)
+		}
+		internal.Info("Waiting for the host to start an episode...")
+		partyEpisode, err = guest.WaitEpisode()
+		if err != nil {
+			internal.Exit("Failed to join watch party", err)
+		}
+	}
+
+	// Guests watch whatever the host picked
+	var initialSelection internal.SelectionOption
+	if guest != nil {
+		initialSelection.Key = "party"
+	} else {
+		initialSelection, err = internal.DynamicSelect(initialOptions)
+		if err != nil {
+			internal.Exit("Error showing initial menu", err)
+		}
 	}
 
 	var selected internal.SelectionOption
@@ -276,7 +411,7 @@ func main() {
 		selectedIndex, _ := strconv.Atoi(selected.Key)
 		selectedResult := jackettResponse.Results[selectedIndex]
 
-		internal.Debug("Selected: %s", selectedResult)
+		internal.Debug("Selected: %s", selectedResult.Title)
 
 		// Ensure the MagnetUri is correctly retrieved
 		user.Watching.URI = selectedResult.MagnetUri
@@ -318,26 +453,49 @@ func main() {
 			user.Watching.FileIndex = user.Watching.Files[selectedIndex].ActualIndex
 		}
 
+	case "party":
+		user.Watching.URI = partyEpisode.MagnetURI
+		user.Watching.FileIndex = partyEpisode.FileIndex
+		internal.Info("Joining the watch party for %s", partyEpisode.Title)
+
+	case "3":
+		// Streams are started on demand when a TV plays a history entry
+		internal.Info("Serving watch history over DLNA, press Ctrl+C to stop")
+		select {}
+
 	case "2":
-		if len(databaseTorrents) == 0 {
-			internal.Exit("No shows in watch history", nil)
-		}
-		// Create options map for database selection
-		dbOptions := make(map[string]string)
-		for i, torrent := range databaseTorrents {
-			dbOptions[fmt.Sprintf("%d", i)] = fmt.Sprintf("%s|%s",
-				torrent.Title,
-				torrent.FileName)
-		}
+		for {
+			if len(databaseTorrents) == 0 {
+				internal.Exit("No shows in watch history", nil)
+			}
+			// Create options map for database selection, finished shows are only listed under manage
+			dbOptions := map[string]string{"manage": "Manage watch history"}
+			for i, torrent := range databaseTorrents {
+				if torrent.Finished {
+					continue
+				}
+				dbOptions[fmt.Sprintf("%d", i)] = fmt.Sprintf("%s (%s)",
+					torrent.DisplayTitle(),
+					internal.ProgressLabel(torrent, internal.LocalGetShowEpisodes(databaseFile, torrent.MagnetURI)))
+			}
 
-		// Show selection menu
-		selected, err = internal.DynamicSelect(dbOptions)
-		if err != nil {
-			internal.Exit("Error showing selection menu", err)
-		}
+			// Show selection menu
+			selected, err = internal.DynamicSelect(dbOptions)
+			if err != nil {
+				internal.Exit("Error showing selection menu", err)
+			}
 
-		if selected.Key == "-1" {
-			internal.Exit("No selection made, exiting", nil)
+			if selected.Key == "-1" {
+				internal.Exit("No selection made, exiting", nil)
+			}
+			if selected.Key != "manage" {
+				break
+			}
+
+			if err := internal.ManageHistoryMenu(databaseFile); err != nil {
+				internal.Output(fmt.Sprintf("Error changing watch history: %v", err))
+			}
+			databaseTorrents = internal.LocalGetAllTorrents(databaseFile)
 		}
 
 		// Get the selected torrent
@@ -347,10 +505,10 @@ func main() {
 		// Set up user watching details
 		user.Watching.URI = selectedTorrent.MagnetURI
 		user.Watching.FileIndex = selectedTorrent.FileIndex
-		user.Player.PlaybackTime = selectedTorrent.PlaybackTime
+		user.Playback.PlaybackTime = selectedTorrent.PlaybackTime
 		user.Resume = true
 
-		internal.Info("Resuming %s at %d seconds", selectedTorrent.FileName, user.Player.PlaybackTime)
+		internal.Info("Resuming %s at %d seconds", selectedTorrent.DisplayTitle(), user.Playback.PlaybackTime)
 	}
 
 	internal.Debug("MagnetUri: %s", user.Watching.URI)
@@ -362,196 +520,667 @@ func main() {
 	}
 
 	// Start streaming directly with the selected/resumed file index
-	user.Player.SocketPath, err = internal.StreamTorrentWebtorrent(user.Watching.URI, user.Watching.FileIndex)
+	currentFile, ok := user.Watching.CurrentFile()
+	if !ok {
+		internal.Exit("Selected file is no longer in the torrent", nil)
+	}
+	user.Watching.FileIndex = currentFile.ActualIndex
+
+	if *hls {
+		streamURL, err := internal.StartStream(user.Watching.URI, currentFile)
+		if err != nil {
+			internal.Exit("Failed to stream torrent", err)
+		}
+		serveHls(streamURL, hlsOptions)
+	}
+
+	if *serveOnly {
+		streamURL, err := internal.StartStream(user.Watching.URI, currentFile)
+		if err != nil {
+			internal.Exit("Failed to stream torrent", err)
+		}
+		serveStream(databaseFile, user, streamURL, *serveJSON, *serveOutput, *serveTrack)
+	}
+
+	// Make sure the show has a history entry to keep its settings in
+	err = internal.LocalUpdateTorrent(databaseFile, user.Watching.URI, user.Watching.FileIndex, user.Playback.PlaybackTime, currentFile.DisplayName)
+	if err == nil {
+		err = internal.LocalUpdateTorrentSettings(databaseFile, user.Watching.URI, func(torrent *internal.TorrentData) {
+			torrent.EpisodeCount = len(internal.SortedEpisodes(user.Watching.Files))
+			torrent.Finished = false
+		})
+	}
 	if err != nil {
-		internal.Exit("Failed to stream torrent", err)
+		internal.Debug("Error updating database: %v", err)
 	}
 
-	internal.Debug("MPV socket path: %s", user.Player.SocketPath)
+	// Offer to link shows to AniList once, and send what couldn't be sent last time
+	anilist := internal.NewAnilistSync(databaseFile)
+	if anilist != nil {
+		if torrent := internal.LocalGetTorrent(databaseFile, user.Watching.URI); torrent != nil && torrent.AnilistID == 0 {
+			if err := internal.LinkAnilist(databaseFile, *torrent, ""); err != nil {
+				internal.Output(fmt.Sprintf("Error linking to AniList: %v", err))
+			}
+		}
+		go func() {
+			if err := anilist.Flush(); err != nil {
+				internal.Debug("AniList updates still queued: %v", err)
+			}
+		}()
+	}
+	trakt := internal.NewTraktScrobbler()
 
-	for {
+	// Chapter skipping can be set per show, falling back to the config
+	showChapterSkip := ""
+	if torrent := internal.LocalFindTorrentByURI(databaseTorrents, user.Watching.URI); torrent != nil {
+		showChapterSkip = torrent.ChapterSkip
+	}
+	if *skipChapters != "" {
+		showChapterSkip = *skipChapters
+		err = internal.LocalUpdateTorrentSettings(databaseFile, user.Watching.URI, func(torrent *internal.TorrentData) {
+			torrent.ChapterSkip = *skipChapters
+		})
+		if err != nil {
+			internal.Debug("Error saving chapter skip setting: %v", err)
+		}
+	}
+	chapterSkipMode := internal.ChapterSkipMode(&config, showChapterSkip)
 
-		// Get all files and find the current one by index
-		allFiles, err := internal.GetTorrentFiles(user.Watching.URI)
+	if *clearSkipSegments {
+		err = internal.LocalUpdateTorrentSettings(databaseFile, user.Watching.URI, func(torrent *internal.TorrentData) {
+			torrent.Intro = internal.SkipSegment{}
+			torrent.Outro = internal.SkipSegment{}
+		})
 		if err != nil {
-			internal.Debug(fmt.Sprintf("Error getting torrent files: %v", err))
-			continue
+			internal.Debug("Error clearing skip segments: %v", err)
+		} else {
+			internal.Info("Cleared the recorded intro and outro")
 		}
+	}
 
-		// Get video duration
-		go func() {
-			for {
-				if user.Player.Started {
-					if user.Player.Duration == 0 {
-						// Get video duration
-						durationPos, err := internal.MPVSendCommand(user.Player.SocketPath, []interface{}{"get_property", "duration"})
-						if err != nil {
-							internal.Debug("Error getting video duration: " + err.Error())
-						} else if durationPos != nil {
-							if duration, ok := durationPos.(float64); ok {
-								user.Player.Duration = int(duration + 0.5) // Round to nearest integer
-								internal.Debug(fmt.Sprintf("Video duration: %d seconds", user.Player.Duration))
-							} else {
-								internal.Debug("Error: duration is not a float64")
-							}
-						}
-						break
+	// Guests follow the host episode by episode
+	usePlaylist := config.MpvPlaylist && (config.Player == "" || config.Player == "mpv") && guest == nil
+	player, playlist, err := startPlayer(guest, user.Watching.URI, user.Watching.Files, currentFile, usePlaylist)
+	if err != nil {
+		internal.Exit("Failed to stream torrent", err)
+	}
+	if _, ok := player.(*internal.GenericPlayer); ok {
+		internal.Info("Playback is not tracked with the generic player")
+	}
+
+	for {
+		currentFile, _ := user.Watching.CurrentFile()
+		var lastSaved time.Time
+		var lastPublished time.Time
+		var chapterSkipper *internal.ChapterSkipper
+		var segmentSkipper *internal.SegmentSkipper
+		var trackMemory *internal.TrackMemory
+		// Set by the action keys in mpv
+		var requestedFile *internal.TorrentFileInfo
+		markedWatched := false
+		sleepEnded := false
+		// Why autoplay stopped while mpv was moving through the playlist
+		playlistStop := ""
+
+		// Playback monitoring and database updates, until the player is closed
+	playback:
+		for event := range player.Events() {
+			if event.Name == "client-message" {
+				if chapterSkipper != nil {
+					chapterSkipper.HandleMessage(event.Args)
+				}
+				if segmentSkipper != nil {
+					segmentSkipper.HandleMessage(event.Args)
+				}
+				if action, ok := internal.ParseAction(event.Args); ok {
+					if file, ok := handleAction(action, player, &user, limits, playlist); ok {
+						requestedFile = &file
+					} else if action == internal.ActionMarkWatched {
+						markedWatched = true
 					}
 				}
-				time.Sleep(1 * time.Second)
+				continue
+			}
+			// mpv finished a seek, let the guests follow right away
+			if event.Name == "playback-restart" && party != nil && user.Playback.Started {
+				publishPartyState(party, player, &user)
+				lastPublished = time.Now()
+			}
+			if event.Name != "property-change" {
+				continue
 			}
-		}()
 
-		// Set the playback speed and seek to the playback time and check if player has started
-		go func() {
-			for {
-				timePos, err := internal.MPVSendCommand(user.Player.SocketPath, []interface{}{"get_property", "time-pos"})
-				if err != nil {
-					internal.Debug("Error getting time position: " + err.Error())
-				} else if timePos != nil {
-					if !user.Player.Started {
-						internal.Debug("Player started")
-						if user.Resume {
-							internal.Debug("Seeking to playback time: %d", user.Player.PlaybackTime)
-							mpvOutput, err := internal.SeekMPV(user.Player.SocketPath, user.Player.PlaybackTime)
+			switch event.Property {
+			case "time-pos":
+				showPosition, ok := event.Float()
+				if !ok {
+					continue
+				}
+
+				if !user.Playback.Started {
+					internal.Debug("Player started")
+					user.Playback.Started = true
+					onPlaybackStarted(player, &user, currentFile, config)
+					trakt.Start(currentFile, internal.PercentageWatched(user.Playback.PlaybackTime, user.Playback.Duration))
+					if party != nil {
+						party.Publish(internal.PartyMessage{
+							Type:      "episode",
+							MagnetURI: user.Watching.URI,
+							FileIndex: user.Watching.FileIndex,
+							Title:     currentFile.DisplayName,
+							StreamURL: internal.CurrentStreamURL(),
+						})
+					}
+
+					// Chapters are known once the file has loaded
+					if mpv, ok := player.(*internal.MPVPlayer); ok {
+						if chapterSkipMode != internal.ChapterSkipOff {
+							chapterSkipper, err = internal.NewChapterSkipper(mpv.Client(), chapterSkipMode, config.ChapterSkipPatterns, config.ChapterSkipKey)
 							if err != nil {
-								internal.Debug("Error seeking to playback time: " + err.Error())
-							} else {
-								internal.Debug("MPV output: %v", mpvOutput)
+								internal.Debug("Error setting up chapter skipping: %v", err)
 							}
-							user.Resume = false
 						}
-						user.Player.Started = true
-						// Set the playback speed
-						if config.SaveMpvSpeed {
-							speedCmd := []interface{}{"set_property", "speed", user.Player.Speed}
-							_, err := internal.MPVSendCommand(user.Player.SocketPath, speedCmd)
-							if err != nil {
-								internal.Debug("Error setting playback speed: " + err.Error())
-							}
+						// Intros and outros marked with a key press, for releases without chapters
+						segmentSkipper, err = internal.NewSegmentSkipper(mpv.Client(), databaseFile, user.Watching.URI, &config)
+						if err != nil {
+							internal.Debug("Error setting up skip segments: %v", err)
+						}
+						if err := internal.BindActionKeys(mpv.Client(), &config); err != nil {
+							internal.Debug("Error binding action keys: %v", err)
+						}
+						// Audio and subtitle tracks picked in earlier episodes, after external tracks are loaded
+						trackMemory, err = internal.NewTrackMemory(mpv.Client(), databaseFile, user.Watching.URI)
+						if err != nil {
+							internal.Debug("Error restoring track choices: %v", err)
 						}
-						break
 					}
 				}
-				time.Sleep(1 * time.Second)
-			}
-		}()
+				if chapterSkipper != nil {
+					chapterSkipper.Update(showPosition)
+				}
+				if segmentSkipper != nil {
+					segmentSkipper.Update(showPosition)
+				}
 
-		// Playback monitoring and database updates
-	skipLoop:
-		for {
-			time.Sleep(1 * time.Second)
-			timePos, err := internal.MPVSendCommand(user.Player.SocketPath, []interface{}{"get_property", "time-pos"})
-			if err != nil && user.Player.Started {
-				internal.Debug("Error getting time position: " + err.Error())
-				// MPV closed or error occurred
-				// Check if we reached completion percentage before starting next episode
-				if user.Player.Started {
-					percentage := float64(user.Player.PlaybackTime) / float64(user.Player.Duration) * 100
+				// Update playback time
+				user.Playback.PlaybackTime = int(showPosition + 0.5)
+
+				// Save to database using the current file name
+				if time.Since(lastSaved) >= time.Second {
+					err = internal.LocalUpdateTorrent(databaseFile, user.Watching.URI, user.Watching.FileIndex, user.Playback.PlaybackTime, currentFile.DisplayName)
 					if err != nil {
-						internal.Debug("Error getting percentage watched: " + err.Error())
+						internal.Debug(fmt.Sprintf("Error updating database: %v", err))
 					}
-					internal.Debug(fmt.Sprintf("Percentage watched: %f", percentage))
-					internal.Debug(fmt.Sprintf("Percentage to mark complete: %d", config.PercentageToMarkCompleted))
-					if percentage >= float64(config.PercentageToMarkCompleted) {
-						// Sort episodes if not already sorted
-						if user.Watching.SortedFiles == nil {
-							// Convert TorrentFileInfo slice to string slice of display names
-							fileNames := make([]string, len(user.Watching.Files))
-							for i, file := range user.Watching.Files {
-								fileNames[i] = file.DisplayName
-							}
-							user.Watching.SortedFiles = internal.FindAndSortEpisodes(fileNames)
-						}
+					err = internal.LocalUpdateEpisode(databaseFile, user.Watching.URI, user.Watching.FileIndex, user.Playback.PlaybackTime, user.Playback.Duration, false)
+					if err != nil {
+						internal.Debug(fmt.Sprintf("Error updating episode history: %v", err))
+					}
+					lastSaved = time.Now()
+				}
+				if !sleepEnded && limits.Expired() {
+					internal.Info("Sleep timer ended, stopping playback")
+					sleepEnded = true
+					player.Quit()
+				}
+				// Regular updates keep guests in step and let late joiners catch up
+				if party != nil && time.Since(lastPublished) >= 2*time.Second {
+					publishPartyState(party, player, &user)
+					lastPublished = time.Now()
+				}
 
-						// Find current episode in sorted list
-						currentFile := user.Watching.Files[user.Watching.FileIndex]
-						nextIndex := -1
-						for i, file := range user.Watching.SortedFiles {
-							if file == currentFile.DisplayName && i < len(user.Watching.SortedFiles)-1 {
-								nextIndex = i + 1
-								break
-							}
-						}
+			case "duration":
+				if duration, ok := event.Float(); ok {
+					user.Playback.Duration = int(duration + 0.5) // Round to nearest integer
+					internal.Debug(fmt.Sprintf("Video duration: %d seconds", user.Playback.Duration))
+				}
 
-						if nextIndex != -1 {
-							// Find the index in original files slice
-							for i, file := range user.Watching.Files {
-								if file.DisplayName == user.Watching.SortedFiles[nextIndex] {
-									internal.Output(fmt.Sprintf("Starting next episode: %s", file.DisplayName))
-									user.Watching.FileIndex = i
-									user.Player.PlaybackTime = 0
-									// Update database with new episode and reset playback time
-									err = internal.LocalUpdateTorrent(databaseFile, user.Watching.URI, i, 0, file.DisplayName)
-									if err != nil {
-										internal.Debug(fmt.Sprintf("Error updating database for next episode: %v", err))
-									}
-									break skipLoop
-								}
-							}
+			case "speed":
+				// Ignore the player's initial value until the saved speed has been restored
+				if speed, ok := event.Float(); ok && user.Playback.Started {
+					user.Playback.Speed = speed
+					if party != nil {
+						publishPartyState(party, player, &user)
+					}
+				}
+
+			case "pause":
+				if paused, ok := event.Bool(); ok {
+					user.Playback.Paused = paused
+					if party != nil && user.Playback.Started {
+						publishPartyState(party, player, &user)
+					}
+					if user.Playback.Started {
+						percentage := internal.PercentageWatched(user.Playback.PlaybackTime, user.Playback.Duration)
+						if paused {
+							trakt.Pause(currentFile, percentage)
 						} else {
-							internal.Output("No more episodes in series")
-							internal.Exit("", nil)
+							trakt.Start(currentFile, percentage)
 						}
-					} else {
-						internal.Exit("", nil)
 					}
 				}
-				break skipLoop // Add this to ensure we break the loop on any MPV error
-			}
 
-			// Episode started
-			if timePos != nil && user.Player.Started {
-				showPosition, ok := timePos.(float64)
-				if !ok {
-					continue
+			case "aid", "sid":
+				if trackMemory != nil {
+					trackMemory.HandleChange(event)
 				}
 
-				// Update playback time
-				user.Player.PlaybackTime = int(showPosition + 0.5)
-				user.Player.Speed, err = internal.GetMPVPlaybackSpeed(user.Player.SocketPath)
-				if err != nil {
-					internal.Debug(fmt.Sprintf("Error getting playback speed: %v", err))
+			case "playlist-pos":
+				position, ok := event.Float()
+				if !ok || playlist == nil {
+					continue
+				}
+				file, ok := playlist.File(int(position))
+				if !ok || file.ActualIndex == user.Watching.FileIndex {
+					continue
 				}
 
-				// Find the file we're currently playing
-				var currentFileName string
-				for _, file := range allFiles {
-					if file.ActualIndex == user.Watching.FileIndex {
-						currentFileName = file.DisplayName
-						break
+				// mpv moved on to another episode, finish the previous one as if the player had closed
+				watched := markedWatched || internal.PercentageWatched(user.Playback.PlaybackTime, user.Playback.Duration) >= float64(config.PercentageToMarkCompleted)
+				saveProgress(databaseFile, &user, currentFile, watched, anilist, trakt)
+				if watched {
+					limits.EpisodeFinished()
+				}
+				if next, ok := internal.NextEpisode(user.Watching.Files, user.Watching.FileIndex); ok && next.ActualIndex == file.ActualIndex {
+					if reason, stop := limits.StopBefore(currentFile, file); stop {
+						playlistStop = reason
+						err = internal.LocalUpdateTorrent(databaseFile, user.Watching.URI, file.ActualIndex, 0, file.DisplayName)
+						if err != nil {
+							internal.Debug(fmt.Sprintf("Error updating database: %v", err))
+						}
+						break playback
 					}
 				}
 
-				// Save to database using the current file name
-				err = internal.LocalUpdateTorrent(databaseFile, user.Watching.URI, user.Watching.FileIndex, user.Player.PlaybackTime, currentFileName)
+				internal.Output(fmt.Sprintf("Starting episode: %s", file.DisplayName))
+				currentFile = file
+				prepareEpisode(databaseFile, &user, file)
+				markedWatched = false
+				chapterSkipper, segmentSkipper, trackMemory = nil, nil, nil
+
+			case "eof-reached":
+				// With autoplay mpv stays open at the end, for the countdown
+				if reached, ok := event.Bool(); ok && reached {
+					break playback
+				}
+			}
+		}
+
+		if playlistStop != "" {
+			internal.ClosePlayer(player)
+			internal.Output(playlistStop)
+			internal.Exit("", nil)
+		}
+
+		// The episode the host moved on to, which also closes the guest's player
+		var partySwitch *internal.PartyMessage
+		if guest != nil {
+			select {
+			case msg, ok := <-guest.Switches():
+				if ok {
+					partySwitch = &msg
+				}
+			default:
+			}
+		}
+
+		// Player closed before anything played
+		if !user.Playback.Started && partySwitch == nil {
+			internal.Exit("", nil)
+		}
+
+		// Check if we reached completion percentage before starting next episode
+		percentage := internal.PercentageWatched(user.Playback.PlaybackTime, user.Playback.Duration)
+		internal.Debug(fmt.Sprintf("Percentage watched: %f", percentage))
+		internal.Debug(fmt.Sprintf("Percentage to mark complete: %d", config.PercentageToMarkCompleted))
+		watched := markedWatched || percentage >= float64(config.PercentageToMarkCompleted)
+
+		// Save the final position
+		saveProgress(databaseFile, &user, currentFile, watched, anilist, trakt)
+		if watched {
+			limits.EpisodeFinished()
+		}
+		if sleepEnded {
+			internal.Exit("Sleep timer ended, progress saved", nil)
+		}
+
+		// Guests that finished the episode wait for the host instead of going ahead
+		if guest != nil && partySwitch == nil && requestedFile == nil && watched {
+			internal.Info("Waiting for the host to start the next episode...")
+			msg, ok := <-guest.Switches()
+			if !ok {
+				internal.Exit("", nil)
+			}
+			partySwitch = &msg
+		}
+
+		var nextFile internal.TorrentFileInfo
+		if requestedFile != nil {
+			nextFile = *requestedFile
+		} else if partySwitch != nil {
+			if partySwitch.MagnetURI != user.Watching.URI {
+				internal.Exit("The host started another show, join the watch party again to follow", nil)
+			}
+			user.Watching.FileIndex = partySwitch.FileIndex
+			var ok bool
+			if nextFile, ok = user.Watching.CurrentFile(); !ok {
+				internal.Exit("The host's episode is not in the torrent", nil)
+			}
+		} else {
+			if !watched || !config.Autoplay {
+				internal.ClosePlayer(player)
+				internal.Exit("", nil)
+			}
+
+			var ok bool
+			nextFile, ok = internal.NextEpisode(user.Watching.Files, user.Watching.FileIndex)
+			if !ok {
+				internal.ClosePlayer(player)
+				// Nothing is left to continue, so the show no longer needs a spot in Continue Watching
+				err = internal.LocalUpdateTorrentSettings(databaseFile, user.Watching.URI, func(torrent *internal.TorrentData) {
+					torrent.Finished = true
+				})
+				if err != nil {
+					internal.Debug(fmt.Sprintf("Error updating database: %v", err))
+				}
+				internal.Output("No more episodes in series")
+				internal.Exit("", nil)
+			}
+		}
+		// Episodes picked in the player are played regardless of the limits
+		if requestedFile == nil {
+			if reason, stop := limits.StopBefore(currentFile, nextFile); stop {
+				// Continue Watching picks up at the next episode
+				err = internal.LocalUpdateTorrent(databaseFile, user.Watching.URI, nextFile.ActualIndex, 0, nextFile.DisplayName)
 				if err != nil {
 					internal.Debug(fmt.Sprintf("Error updating database: %v", err))
 				}
-				internal.Debug("Database updated successfully")
+				internal.ClosePlayer(player)
+				internal.Output(reason)
+				internal.Exit("", nil)
 			}
 		}
 
-		// Start the next episode after the skipLoop if we have one
-		if user.Player.PlaybackTime == 0 { // This indicates we're ready for next episode
-			var err error
-			user.Player.Duration = 0    // Reset duration for new episode
-			user.Player.Started = false // Reset started flag
-			user.Player.SocketPath, err = internal.StreamTorrentWebtorrent(user.Watching.URI, user.Watching.FileIndex)
+		// Give the user a moment to pick something else before autoplaying
+		if requestedFile == nil && partySwitch == nil && config.AutoplayCountdown > 0 {
+			choice, err := internal.AutoplayCountdown(player, nextFile.DisplayName, config.AutoplayCountdown)
 			if err != nil {
-				internal.Debug(fmt.Sprintf("Error starting next episode: %v", err))
-				internal.Exit("", err)
+				internal.Debug("Error showing autoplay countdown: %v", err)
+			}
+			switch choice {
+			case internal.AutoplayChoose:
+				file, ok := selectEpisode(user.Watching.Files)
+				if !ok {
+					internal.ClosePlayer(player)
+					internal.Exit("No selection made, exiting", nil)
+				}
+				nextFile = file
+			case internal.AutoplayReplay:
+				nextFile = currentFile
+			case internal.AutoplayQuit:
+				internal.ClosePlayer(player)
+				internal.Exit("", nil)
 			}
 		}
+		internal.ClosePlayer(player)
+
+		internal.Output(fmt.Sprintf("Starting episode: %s", nextFile.DisplayName))
+		prepareEpisode(databaseFile, &user, nextFile)
+		player, playlist, err = startPlayer(guest, user.Watching.URI, user.Watching.Files, nextFile, usePlaylist)
+		if err != nil {
+			internal.Debug(fmt.Sprintf("Error starting next episode: %v", err))
+			internal.Exit("", err)
+		}
 	}
+}
 
-	// Set up signal handling
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-sigChan
-		internal.CleanupWebtorrent()
-		os.Exit(0)
-	}()
+// saveProgress saves the position of an episode to the watch history and the episode history
+func saveProgress(databaseFile string, user *internal.User, file internal.TorrentFileInfo, watched bool, anilist *internal.AnilistSync, trakt *internal.TraktScrobbler) {
+	err := internal.LocalUpdateTorrent(databaseFile, user.Watching.URI, file.ActualIndex, user.Playback.PlaybackTime, file.DisplayName)
+	if err != nil {
+		internal.Debug(fmt.Sprintf("Error updating database: %v", err))
+	}
+	err = internal.LocalUpdateEpisode(databaseFile, user.Watching.URI, file.ActualIndex, user.Playback.PlaybackTime, user.Playback.Duration, watched)
+	if err != nil {
+		internal.Debug(fmt.Sprintf("Error updating episode history: %v", err))
+	}
+	if watched {
+		anilist.EpisodeWatched(user.Watching.URI, file, user.Watching.Files)
+	}
+
+	// Episodes marked watched by hand count as fully watched for Trakt
+	percentage := internal.PercentageWatched(user.Playback.PlaybackTime, user.Playback.Duration)
+	if watched {
+		percentage = 100
+	}
+	if user.Playback.Started {
+		trakt.Stop(file, percentage)
+	}
+}
+
+// prepareEpisode switches the session to another episode, resuming it if it was left unfinished
+func prepareEpisode(databaseFile string, user *internal.User, file internal.TorrentFileInfo) {
+	user.Watching.FileIndex = file.ActualIndex
+	user.Playback.PlaybackTime = 0
+	// Pick up where an unfinished episode was left, e.g. when going back to it
+	if progress, ok := internal.LocalGetShowEpisodes(databaseFile, user.Watching.URI)[file.ActualIndex]; ok && !progress.Watched {
+		user.Playback.PlaybackTime = progress.PlaybackTime
+		user.Resume = progress.PlaybackTime > 0
+	}
+	// Update database with new episode and its playback time
+	err := internal.LocalUpdateTorrent(databaseFile, user.Watching.URI, file.ActualIndex, user.Playback.PlaybackTime, file.DisplayName)
+	if err != nil {
+		internal.Debug(fmt.Sprintf("Error updating database for next episode: %v", err))
+	}
+
+	user.Playback.Duration = 0    // Reset duration for new episode
+	user.Playback.Started = false // Reset started flag
+}
 
+// startPlayer streams an episode, as part of an mpv playlist of all episodes if asked to,
+// or playing the host's stream when joining a watch party on the same machine
+func startPlayer(guest *internal.PartyGuest, magnetURI string, files []internal.TorrentFileInfo, file internal.TorrentFileInfo, usePlaylist bool) (internal.Player, *internal.EpisodePlaylist, error) {
+	if usePlaylist {
+		player, playlist, err := internal.StreamTorrentPlaylist(magnetURI, files, file)
+		if err == nil {
+			return player, playlist, nil
+		}
+		internal.Debug("Playing without a playlist: %v", err)
+	}
+	if guest == nil {
+		player, err := internal.StreamTorrentWebtorrent(magnetURI, file)
+		return player, nil, err
+	}
+
+	var player internal.Player
+	var err error
+	if guest.SharesHostStream() {
+		player, err = guest.PlayHostStream(file.DisplayName)
+	} else {
+		player, err = internal.StreamTorrentWebtorrent(magnetURI, file)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	guest.Follow(player, file.ActualIndex)
+	return player, nil, nil
+}
+
+// publishPartyState sends the host's position, pause state and speed to the watch party
+func publishPartyState(party internal.PartyPublisher, player internal.Player, user *internal.User) {
+	position, err := player.Position()
+	if err != nil {
+		position = float64(user.Playback.PlaybackTime)
+	}
+	speed, err := player.Speed()
+	if err != nil {
+		speed = user.Playback.Speed
+	}
+	party.Publish(internal.PartyMessage{
+		Type:      "state",
+		MagnetURI: user.Watching.URI,
+		FileIndex: user.Watching.FileIndex,
+		Position:  position,
+		Paused:    user.Playback.Paused,
+		Speed:     speed,
+	})
+}
+
+// handleAction runs an action triggered from mpv and returns the episode to switch to, if any
+func handleAction(action string, player internal.Player, user *internal.User, limits *internal.SessionLimits, playlist *internal.EpisodePlaylist) (internal.TorrentFileInfo, bool) {
+	internal.Debug("Action from player: %s", action)
+
+	var file internal.TorrentFileInfo
+	var ok bool
+	switch action {
+	case internal.ActionNextEpisode:
+		if file, ok = internal.NextEpisode(user.Watching.Files, user.Watching.FileIndex); !ok {
+			showText(player, "No next episode")
+		}
+	case internal.ActionPreviousEpisode:
+		if file, ok = internal.PreviousEpisode(user.Watching.Files, user.Watching.FileIndex); !ok {
+			showText(player, "No previous episode")
+		}
+	case internal.ActionMarkWatched:
+		showText(player, "Marked as watched, the next episode starts when you close the player")
+	case internal.ActionEpisodeList:
+		file, ok = selectEpisode(user.Watching.Files)
+	case internal.ActionStopAfter:
+		showText(player, limits.ToggleStopAfterCurrent())
+	case internal.ActionSleepTimer:
+		showText(player, limits.CycleSleepTimer())
+	case internal.ActionReplay:
+		if err := player.Seek(0); err != nil {
+			internal.Debug("Error restarting episode: %v", err)
+		}
+	}
+
+	if ok && playlist != nil {
+		// Episodes in mpv's playlist are switched to in place
+		if position, inPlaylist := playlist.Position(file.ActualIndex); inPlaylist {
+			if err := player.(*internal.MPVPlayer).Client().SetProperty("playlist-pos", position); err == nil {
+				return internal.TorrentFileInfo{}, false
+			}
+		}
+	}
+	if ok {
+		// Closing the player ends the playback loop, which then starts the chosen episode
+		if err := player.Quit(); err != nil {
+			internal.Debug("Error closing player: %v", err)
+		}
+	}
+	return file, ok
+}
+
+// selectEpisode shows the files of the torrent while the player keeps running
+func selectEpisode(files []internal.TorrentFileInfo) (internal.TorrentFileInfo, bool) {
+	options := make(map[string]string)
+	for _, file := range files {
+		options[strconv.Itoa(file.ActualIndex)] = file.DisplayName
+	}
+
+	selected, err := internal.DynamicSelect(options)
+	if err != nil {
+		internal.Debug("Error showing episode list: %v", err)
+		return internal.TorrentFileInfo{}, false
+	}
+	if selected.Key == "" || selected.Key == "-1" {
+		return internal.TorrentFileInfo{}, false
+	}
+
+	index, _ := strconv.Atoi(selected.Key)
+	watching := internal.Torrent{Files: files, FileIndex: index}
+	return watching.CurrentFile()
+}
+
+// showText shows a message on the player's OSD, when it has one
+func showText(player internal.Player, text string) {
+	if mpv, ok := player.(*internal.MPVPlayer); ok {
+		mpv.Client().ShowText(text, 3*time.Second)
+	}
+}
+
+// serveHls transcodes the input to HLS and serves it until interrupted
+func serveHls(input string, options internal.HlsOptions) {
+	internal.Info("Transcoding to HLS, waiting for the first segment...")
+	transcoder, err := internal.StartHlsTranscode(input, options)
+	if err != nil {
+		internal.Exit("Failed to start HLS transcoding", err)
+	}
+
+	internal.Output(fmt.Sprintf("Watch in a browser: %s", transcoder.PageURL))
+	internal.Output(fmt.Sprintf("HLS playlist: %s", transcoder.PlaylistURL))
+
+	if err := transcoder.Wait(); err != nil {
+		internal.Exit("Transcoding stopped", err)
+	}
+	internal.Info("Transcoding finished, still serving. Press Ctrl+C to stop")
+	select {}
+}
+
+// serveStream shares the stream with other players until interrupted
+func serveStream(databaseFile string, user internal.User, streamURL string, asJSON bool, outputFile string, track bool) {
+	server, err := internal.ServeStream(databaseFile, user.Watching, streamURL, track)
+	if err != nil {
+		internal.Exit("Failed to serve stream", err)
+	}
+
+	if asJSON {
+		info, err := json.MarshalIndent(server.Info(), "", "  ")
+		if err != nil {
+			internal.Exit("Failed to encode stream details", err)
+		}
+		internal.Output(string(info))
+	} else {
+		internal.Output(server.URL)
+	}
+
+	if outputFile != "" {
+		if err := server.WriteInfo(outputFile, asJSON || strings.HasSuffix(outputFile, ".json")); err != nil {
+			internal.Exit("Failed to write stream details", err)
+		}
+	}
+
+	if track {
+		// Remember which episode is being served so it can be resumed later
+		err := internal.LocalUpdateTorrent(databaseFile, user.Watching.URI, server.FileIndex, user.Playback.PlaybackTime, server.Title)
+		if err != nil {
+			internal.Debug("Error updating database: %v", err)
+		}
+	}
+
+	internal.Info("Serving stream, press Ctrl+C to stop")
+	select {}
+}
+
+// onPlaybackStarted resumes the saved position and restores the session's player settings
+func onPlaybackStarted(player internal.Player, user *internal.User, currentFile internal.TorrentFileInfo, config internal.ProgramConfig) {
+	if user.Resume {
+		internal.Debug("Seeking to playback time: %d", user.Playback.PlaybackTime)
+		if err := player.Seek(user.Playback.PlaybackTime); err != nil {
+			internal.Debug("Error seeking to playback time: " + err.Error())
+		}
+		user.Resume = false
+	}
+
+	// Load subtitle and audio files shipped next to the episode
+	if mpv, ok := player.(*internal.MPVPlayer); ok {
+		if err := internal.LoadExternalSubtitles(mpv.Client(), currentFile); err != nil {
+			internal.Debug("Error loading external subtitles: " + err.Error())
+		}
+		if err := internal.LoadExternalAudio(mpv.Client(), currentFile); err != nil {
+			internal.Debug("Error loading external audio: " + err.Error())
+		}
+		if config.ForcedSubtitlesOnly {
+			if err := internal.SelectForcedSubtitles(mpv.Client()); err != nil {
+				internal.Debug("Error selecting forced subtitles: " + err.Error())
+			}
+		}
+	}
+
+	// Set the playback speed
+	if config.SaveMpvSpeed && user.Playback.Speed > 0 {
+		if err := player.SetSpeed(user.Playback.Speed); err != nil {
+			internal.Debug("Error setting playback speed: " + err.Error())
+		}
+	}
 }
@@ -8,6 +8,7 @@ require (
 	github.com/charmbracelet/bubbletea v1.1.2
 	github.com/dustin/go-humanize v1.0.0
 	golang.org/x/net v0.23.0
+	modernc.org/sqlite v1.21.1
 )
 
 require (
@@ -100,6 +101,5 @@ require (
 	modernc.org/libc v1.22.3 // indirect
 	modernc.org/mathutil v1.5.0 // indirect
 	modernc.org/memory v1.5.0 // indirect
-	modernc.org/sqlite v1.21.1 // indirect
 	zombiezen.com/go/sqlite v0.13.1 // indirect
 )
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// AniList list statuses buttercup sets
+const (
+	AnilistWatching  = "CURRENT"
+	AnilistCompleted = "COMPLETED"
+)
+
+// AnilistNotLinked marks a show the user said isn't on AniList, so linking isn't offered again
+const AnilistNotLinked = -1
+
+// AnilistClient talks to the AniList GraphQL API
+type AnilistClient struct {
+	APIURL string
+	Token  string
+	client *http.Client
+}
+
+// AnilistMedia is an anime found on AniList
+type AnilistMedia struct {
+	ID       int    `json:"id"`
+	Episodes int    `json:"episodes"`
+	Format   string `json:"format"`
+	Year     int    `json:"seasonYear"`
+	Title    struct {
+		Romaji  string `json:"romaji"`
+		English string `json:"english"`
+	} `json:"title"`
+}
+
+// Name is the English title when there is one, the romaji one otherwise
+func (m AnilistMedia) Name() string {
+	if m.Title.English != "" {
+		return m.Title.English
+	}
+	return m.Title.Romaji
+}
+
+// NewAnilistClient creates a client for the API at apiURL, the token is only needed to change the user's list
+func NewAnilistClient(apiURL string, token string) *AnilistClient {
+	return &AnilistClient{
+		APIURL: apiURL,
+		Token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// AnilistAuthURL is where the user authorizes buttercup and gets a token to paste back
+func AnilistAuthURL(clientID string) string {
+	return fmt.Sprintf("https://anilist.co/api/v2/oauth/authorize?client_id=%s&response_type=token", clientID)
+}
+
+// query runs a GraphQL query and decodes its data into result
+func (c *AnilistClient) query(query string, variables map[string]interface{}, result interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", c.APIURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach AniList: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read AniList response: %w", err)
+	}
+
+	var response struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return fmt.Errorf("bad response from AniList: %d", resp.StatusCode)
+	}
+	if len(response.Errors) > 0 {
+		return fmt.Errorf("AniList error: %s", response.Errors[0].Message)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad response from AniList: %d", resp.StatusCode)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(response.Data, result); err != nil {
+		return fmt.Errorf("failed to parse AniList response: %w", err)
+	}
+	return nil
+}
+
+// Viewer returns the name of the user the token belongs to
+func (c *AnilistClient) Viewer() (string, error) {
+	var result struct {
+		Viewer struct {
+			Name string `json:"name"`
+		} `json:"Viewer"`
+	}
+	if err := c.query(`query { Viewer { id name } }`, nil, &result); err != nil {
+		return "", err
+	}
+	return result.Viewer.Name, nil
+}
+
+// SearchAnime looks up anime by title
+func (c *AnilistClient) SearchAnime(title string) ([]AnilistMedia, error) {
+	var result struct {
+		Page struct {
+			Media []AnilistMedia `json:"media"`
+		} `json:"Page"`
+	}
+	err := c.query(`query ($search: String) {
+		Page(perPage: 10) {
+			media(search: $search, type: ANIME) { id episodes format seasonYear title { romaji english } }
+		}
+	}`, map[string]interface{}{"search": title}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result.Page.Media, nil
+}
+
+// SaveProgress sets how many episodes of an anime the user watched and its list status
+func (c *AnilistClient) SaveProgress(mediaID int, progress int, status string) error {
+	return c.query(`mutation ($mediaId: Int, $progress: Int, $status: MediaListStatus) {
+		SaveMediaListEntry(mediaId: $mediaId, progress: $progress, status: $status) { id progress status }
+	}`, map[string]interface{}{"mediaId": mediaID, "progress": progress, "status": status}, nil)
+}
@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const anilistUsage = `Usage: buttercup anilist <command> [arguments]
+
+Shows are given by their number in "buttercup history list".
+
+  login                  Authorize buttercup to update your AniList
+  link <show> [title]    Pick the AniList anime of a show, searching by title
+  unlink <show>          Stop updating AniList for a show
+  sync                   Push the progress that couldn't be sent while offline`
+
+// anilistTokenFile keeps the AniList token next to the watch database, readable only by the user
+func anilistTokenFile() string {
+	return filepath.Join(os.ExpandEnv(GetGlobalConfig().StoragePath), "anilist_token")
+}
+
+// LoadAnilistToken returns the stored AniList token, empty when the user hasn't logged in
+func LoadAnilistToken() string {
+	data, err := os.ReadFile(anilistTokenFile())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// SaveAnilistToken stores the AniList token
+func SaveAnilistToken(token string) error {
+	return WriteFileAtomic(anilistTokenFile(), []byte(token+"\n"), 0600)
+}
+
+// AnilistSync pushes the episodes watched of linked shows to AniList. Updates are queued in the
+// watch database first, so the ones made while offline are sent the next time AniList can be reached.
+type AnilistSync struct {
+	client       *AnilistClient
+	databaseFile string
+	mu           sync.Mutex
+}
+
+// NewAnilistSync returns nil when AniList sync is off or the user hasn't logged in
+func NewAnilistSync(databaseFile string) *AnilistSync {
+	config := GetGlobalConfig()
+	if !config.AnilistSync {
+		return nil
+	}
+	token := LoadAnilistToken()
+	if token == "" {
+		Info("AniList sync is on but not logged in, run buttercup anilist login")
+		return nil
+	}
+	return &AnilistSync{client: NewAnilistClient(config.AnilistApiUrl, token), databaseFile: databaseFile}
+}
+
+// EpisodeWatched queues the progress of a linked show after one of its episodes was watched and sends it
+func (s *AnilistSync) EpisodeWatched(magnetURI string, file TorrentFileInfo, files []TorrentFileInfo) {
+	if s == nil {
+		return
+	}
+	torrent := LocalGetTorrent(s.databaseFile, magnetURI)
+	if torrent == nil || torrent.AnilistID <= 0 {
+		return
+	}
+	progress, ok := EpisodeNumber(file.FileName())
+	if !ok {
+		Debug("No episode number in %s, not updating AniList", file.DisplayName)
+		return
+	}
+	status := AnilistWatching
+	if anilistLastEpisode(file, files) {
+		status = AnilistCompleted
+	}
+
+	if err := queueAnilistProgress(s.databaseFile, torrent.AnilistID, progress, status); err != nil {
+		Debug("Error queuing AniList update: %v", err)
+		return
+	}
+	if err := s.Flush(); err != nil {
+		Debug("AniList update queued for later: %v", err)
+	}
+}
+
+// Flush sends the queued updates, stopping at the first one that fails
+func (s *AnilistSync) Flush() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	db, err := openWatchDatabase(s.databaseFile)
+	if err != nil {
+		return err
+	}
+	type update struct {
+		mediaID, progress int
+		status            string
+		updatedAt         int64
+	}
+	var updates []update
+	rows, err := db.Query("SELECT media_id, progress, status, updated_at FROM anilist_progress WHERE synced = 0 ORDER BY updated_at")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var u update
+		if err := rows.Scan(&u.mediaID, &u.progress, &u.status, &u.updatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		updates = append(updates, u)
+	}
+	rows.Close()
+
+	for _, u := range updates {
+		if err := s.client.SaveProgress(u.mediaID, u.progress, u.status); err != nil {
+			return err
+		}
+		Debug("Updated AniList %d to episode %d (%s)", u.mediaID, u.progress, u.status)
+		// A newer update queued meanwhile still has to be sent
+		_, err := db.Exec("UPDATE anilist_progress SET synced = 1 WHERE media_id = ? AND updated_at = ?", u.mediaID, u.updatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueAnilistProgress records progress to send, never going back from an episode already reached
+func queueAnilistProgress(databaseFile string, mediaID int, progress int, status string) error {
+	db, err := openWatchDatabase(databaseFile)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO anilist_progress (media_id, progress, status, updated_at, synced) VALUES (?, ?, ?, ?, 0)
+		ON CONFLICT (media_id) DO UPDATE SET progress = excluded.progress, status = excluded.status,
+			updated_at = excluded.updated_at, synced = 0
+		WHERE excluded.progress > anilist_progress.progress
+			OR (excluded.status = ? AND anilist_progress.status != ?)`,
+		mediaID, progress, status, time.Now().UnixNano(), AnilistCompleted, AnilistCompleted)
+	return err
+}
+
+// anilistLastEpisode reports whether no episode of the torrent comes after file
+func anilistLastEpisode(file TorrentFileInfo, files []TorrentFileInfo) bool {
+	if _, _, ok := ParseEpisodeNumber(file.FileName()); ok {
+		_, hasNext := NextEpisode(files, file.ActualIndex)
+		return !hasNext
+	}
+	episode, _ := EpisodeNumber(file.FileName())
+	for _, other := range files {
+		if n, ok := EpisodeNumber(other.FileName()); ok && n > episode {
+			return false
+		}
+	}
+	return true
+}
+
+// LinkAnilist searches AniList for a show and lets the user pick the matching anime, or say it isn't on AniList
+func LinkAnilist(databaseFile string, torrent TorrentData, search string) error {
+	config := GetGlobalConfig()
+	if search == "" && torrent.ShowTitle != "" {
+		search = ReleaseTitle(torrent.ShowTitle)
+	}
+	if search == "" {
+		search = ReleaseTitle(displayFileName(torrent.Title))
+	}
+	results, err := NewAnilistClient(config.AnilistApiUrl, "").SearchAnime(search)
+	if err != nil {
+		return err
+	}
+
+	Info("Linking %s to AniList", torrent.DisplayTitle())
+	options := map[string]string{"none": "Not on AniList"}
+	for i, media := range results {
+		label := media.Name()
+		if media.Year > 0 {
+			label += fmt.Sprintf(" (%s %d", media.Format, media.Year)
+		} else {
+			label += fmt.Sprintf(" (%s", media.Format)
+		}
+		if media.Episodes > 0 {
+			label += fmt.Sprintf(", %d episodes", media.Episodes)
+		}
+		options[strconv.Itoa(i)] = label + ")"
+	}
+	selected, err := DynamicSelect(options)
+	if err != nil {
+		return err
+	}
+
+	mediaID := AnilistNotLinked
+	switch selected.Key {
+	case "-1", "":
+		return nil
+	case "none":
+		// Not asked again, linking is still possible with buttercup anilist link
+	default:
+		index, _ := strconv.Atoi(selected.Key)
+		mediaID = results[index].ID
+	}
+	return LocalUpdateTorrentSettings(databaseFile, torrent.MagnetURI, func(torrent *TorrentData) {
+		torrent.AnilistID = mediaID
+	})
+}
+
+// RunAnilistCommand runs a "buttercup anilist" subcommand
+func RunAnilistCommand(databaseFile string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing command\n%s", anilistUsage)
+	}
+	config := GetGlobalConfig()
+
+	switch args[0] {
+	case "help":
+		fmt.Println(anilistUsage)
+	case "login":
+		if config.AnilistClientID == "" {
+			return fmt.Errorf("set AnilistClientID in the config to the ID of an AniList API client " +
+				"(create one at https://anilist.co/settings/developer with https://anilist.co/api/v2/oauth/pin as the redirect URL)")
+		}
+		fmt.Println("Open this page, authorize buttercup and paste the token it shows:")
+		fmt.Println(AnilistAuthURL(config.AnilistClientID))
+		token, err := promptInput("Token")
+		if err != nil {
+			return err
+		}
+		name, err := NewAnilistClient(config.AnilistApiUrl, token).Viewer()
+		if err != nil {
+			return fmt.Errorf("the token didn't work: %w", err)
+		}
+		if err := SaveAnilistToken(token); err != nil {
+			return fmt.Errorf("failed to save AniList token: %w", err)
+		}
+		fmt.Printf("Logged in to AniList as %s\n", name)
+		if !config.AnilistSync {
+			fmt.Println("Set AnilistSync to true in the config to update AniList while watching")
+		}
+	case "link", "unlink":
+		if len(args) < 2 {
+			return fmt.Errorf("missing show number\n%s", anilistUsage)
+		}
+		torrent, err := historyShow(databaseFile, args[1])
+		if err != nil {
+			return err
+		}
+		if args[0] == "unlink" {
+			return LocalUpdateTorrentSettings(databaseFile, torrent.MagnetURI, func(torrent *TorrentData) {
+				torrent.AnilistID = 0
+			})
+		}
+		return LinkAnilist(databaseFile, torrent, strings.Join(args[2:], " "))
+	case "sync":
+		token := LoadAnilistToken()
+		if token == "" {
+			return fmt.Errorf("not logged in, run buttercup anilist login")
+		}
+		anilist := &AnilistSync{client: NewAnilistClient(config.AnilistApiUrl, token), databaseFile: databaseFile}
+		if err := anilist.Flush(); err != nil {
+			return err
+		}
+		fmt.Println("AniList is up to date")
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], anilistUsage)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAnilist answers the GraphQL queries buttercup sends and records the list updates
+type fakeAnilist struct {
+	mu      sync.Mutex
+	down    bool
+	search  string
+	updates []map[string]interface{}
+	auth    string
+}
+
+func (f *fakeAnilist) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	var request struct {
+		Query     string                 `json:"query"`
+		Variables map[string]interface{} `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case strings.Contains(request.Query, "Page"):
+		f.search, _ = request.Variables["search"].(string)
+		w.Write([]byte(`{"data": {"Page": {"media": [
+			{"id": 154587, "episodes": 28, "format": "TV", "seasonYear": 2023, "title": {"romaji": "Sousou no Frieren", "english": "Frieren: Beyond Journey's End"}},
+			{"id": 170068, "episodes": 0, "format": "ONA", "seasonYear": 0, "title": {"romaji": "Sousou no Frieren: Mini", "english": null}}
+		]}}}`))
+	case strings.Contains(request.Query, "SaveMediaListEntry"):
+		f.auth = r.Header.Get("Authorization")
+		f.updates = append(f.updates, request.Variables)
+		w.Write([]byte(`{"data": {"SaveMediaListEntry": {"id": 1}}}`))
+	default:
+		w.Write([]byte(`{"errors": [{"message": "unknown query"}]}`))
+	}
+}
+
+func TestAnilistSearchAnime(t *testing.T) {
+	fake := &fakeAnilist{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	results, err := NewAnilistClient(server.URL, "").SearchAnime("Frieren")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.search != "Frieren" {
+		t.Errorf("searched for %q", fake.search)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results", len(results))
+	}
+	if media := results[0]; media.ID != 154587 || media.Episodes != 28 || media.Format != "TV" || media.Year != 2023 ||
+		media.Name() != "Frieren: Beyond Journey's End" {
+		t.Errorf("unexpected first result %+v", media)
+	}
+	if name := results[1].Name(); name != "Sousou no Frieren: Mini" {
+		t.Errorf("got name %q, want the romaji title when there is no English one", name)
+	}
+}
+
+func TestAnilistSaveProgress(t *testing.T) {
+	fake := &fakeAnilist{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	if err := NewAnilistClient(server.URL, "token").SaveProgress(154587, 5, AnilistWatching); err != nil {
+		t.Fatal(err)
+	}
+	if fake.auth != "Bearer token" {
+		t.Errorf("got Authorization %q", fake.auth)
+	}
+	if len(fake.updates) != 1 {
+		t.Fatalf("got %d updates", len(fake.updates))
+	}
+	// JSON numbers decode as float64
+	update := fake.updates[0]
+	if update["mediaId"] != 154587.0 || update["progress"] != 5.0 || update["status"] != AnilistWatching {
+		t.Errorf("unexpected update %v", update)
+	}
+}
+
+func TestAnilistEpisodeWatchedInBatch(t *testing.T) {
+	fake := &fakeAnilist{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	SetGlobalConfig(&ProgramConfig{StoragePath: t.TempDir()})
+	databaseFile := filepath.Join(t.TempDir(), "buttercup.db")
+	magnetURI := "magnet:?xt=urn:btih:bbb"
+	// The folder of a batch names the range of episodes and the files their resolution, neither is the episode
+	batch := "[Group] Frieren - 01-28 (Batch) [1920x1080]/"
+	var files []TorrentFileInfo
+	for i, name := range []string{"[Group] Frieren - 05 [1920x1080].mkv", "[Group] Frieren - 27 [1920x1080].mkv", "[Group] Frieren - 28 [1920x1080].mkv"} {
+		files = append(files, TorrentFileInfo{DisplayName: batch + name + " (1.4 GB)", Path: batch + name, ActualIndex: i})
+	}
+	if err := LocalUpdateTorrent(databaseFile, magnetURI, 0, 0, files[0].DisplayName); err != nil {
+		t.Fatal(err)
+	}
+	err := LocalUpdateTorrentSettings(databaseFile, magnetURI, func(torrent *TorrentData) {
+		torrent.AnilistID = 154587
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	anilist := &AnilistSync{client: NewAnilistClient(server.URL, "token"), databaseFile: databaseFile}
+	for _, test := range []struct {
+		file     int
+		progress float64
+		status   string
+	}{
+		{0, 5, AnilistWatching},
+		{2, 28, AnilistCompleted},
+	} {
+		anilist.EpisodeWatched(magnetURI, files[test.file], files)
+		if len(fake.updates) == 0 {
+			t.Fatalf("%s: AniList was not updated", files[test.file].Path)
+		}
+		if update := fake.updates[len(fake.updates)-1]; update["progress"] != test.progress || update["status"] != test.status {
+			t.Errorf("%s: got update %v, want episode %v %s", files[test.file].Path, update, test.progress, test.status)
+		}
+	}
+}
+
+func TestAnilistSyncQueuesWhileOffline(t *testing.T) {
+	fake := &fakeAnilist{down: true}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	SetGlobalConfig(&ProgramConfig{StoragePath: t.TempDir()})
+	databaseFile := filepath.Join(t.TempDir(), "buttercup.db")
+	magnetURI := "magnet:?xt=urn:btih:aaa"
+	files := []TorrentFileInfo{
+		{DisplayName: "[Group] Frieren - 05 [1080p].mkv (1.4 GB)", Path: "[Group] Frieren - 05 [1080p].mkv", ActualIndex: 0},
+		{DisplayName: "[Group] Frieren - 06 [1080p].mkv (1.4 GB)", Path: "[Group] Frieren - 06 [1080p].mkv", ActualIndex: 1},
+	}
+	if err := LocalUpdateTorrent(databaseFile, magnetURI, 0, 0, files[0].DisplayName); err != nil {
+		t.Fatal(err)
+	}
+	err := LocalUpdateTorrentSettings(databaseFile, magnetURI, func(torrent *TorrentData) {
+		torrent.AnilistID = 154587
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queued := func() (progress int, status string, synced bool) {
+		t.Helper()
+		db, err := openWatchDatabase(databaseFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.QueryRow("SELECT progress, status, synced FROM anilist_progress WHERE media_id = ?", 154587).Scan(&progress, &status, &synced)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return progress, status, synced
+	}
+
+	anilist := &AnilistSync{client: NewAnilistClient(server.URL, "token"), databaseFile: databaseFile}
+	anilist.EpisodeWatched(magnetURI, files[0], files)
+	if progress, status, synced := queued(); progress != 5 || status != AnilistWatching || synced {
+		t.Errorf("got progress %d, status %s, synced %v while AniList is down", progress, status, synced)
+	}
+	if len(fake.updates) != 0 {
+		t.Errorf("got %d updates while AniList is down", len(fake.updates))
+	}
+
+	fake.mu.Lock()
+	fake.down = false
+	fake.mu.Unlock()
+	if err := anilist.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, synced := queued(); !synced {
+		t.Error("the update is still queued after AniList came back")
+	}
+	if len(fake.updates) != 1 || fake.updates[0]["progress"] != 5.0 {
+		t.Errorf("unexpected updates %v", fake.updates)
+	}
+
+	// Sent updates aren't sent again
+	if err := anilist.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.updates) != 1 {
+		t.Errorf("got %d updates after flushing twice", len(fake.updates))
+	}
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/bubbletea"
+)
+
+// Choices at the end of an episode
+const (
+	AutoplayContinue = "continue"
+	AutoplayChoose   = "choose"
+	AutoplayReplay   = "replay"
+	AutoplayQuit     = "quit"
+)
+
+type countdownTick struct{}
+
+type countdownChoice string
+
+// countdownModel counts down to the next episode in the terminal, mirrored on mpv's OSD
+type countdownModel struct {
+	player    Player
+	next      string
+	remaining int
+	choice    string
+}
+
+func (m *countdownModel) Init() tea.Cmd {
+	m.showOSD()
+	return tick()
+}
+
+func tick() tea.Cmd {
+	return tea.Tick(time.Second, func(time.Time) tea.Msg { return countdownTick{} })
+}
+
+func (m *countdownModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case countdownTick:
+		m.remaining--
+		if m.remaining <= 0 {
+			m.choice = AutoplayContinue
+			return m, tea.Quit
+		}
+		m.showOSD()
+		return m, tick()
+	case countdownChoice:
+		m.choice = string(msg)
+		return m, tea.Quit
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "enter", "c", "n":
+			m.choice = AutoplayContinue
+		case "l":
+			m.choice = AutoplayChoose
+		case "r":
+			m.choice = AutoplayReplay
+		case "q", "esc", "ctrl+c":
+			m.choice = AutoplayQuit
+		default:
+			return m, nil
+		}
+		return m, tea.Quit
+	}
+	return m, nil
+}
+
+func (m *countdownModel) View() string {
+	if m.choice != "" {
+		return ""
+	}
+	return fmt.Sprintf("Next: %s in %ds\n[Enter] play now  [l] choose episode  [r] replay  [q] quit\n", m.next, m.remaining)
+}
+
+// showOSD mirrors the countdown in mpv while it is kept open at the end of the file
+func (m *countdownModel) showOSD() {
+	mpv, ok := m.player.(*MPVPlayer)
+	if !ok || mpv.Client() == nil {
+		return
+	}
+	config := GetGlobalConfig()
+	mpv.Client().ShowText(fmt.Sprintf("Next: %s in %ds\n%s play now, %s choose episode, %s replay, q quit",
+		m.next, m.remaining, config.NextEpisodeKey, config.EpisodeListKey, config.ReplayKey), 1500*time.Millisecond)
+}
+
+// AutoplayCountdown counts down before the next episode and returns what the user chose.
+// The choice can be made in the terminal or, while mpv is still open, with the action keys.
+func AutoplayCountdown(player Player, next string, seconds int) (string, error) {
+	model := &countdownModel{player: player, next: next, remaining: seconds}
+	program := tea.NewProgram(model)
+
+	// Key presses in mpv arrive as player events
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		events := player.Events()
+		for {
+			select {
+			case <-done:
+				return
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				action, ok := ParseAction(event.Args)
+				if !ok {
+					continue
+				}
+				switch action {
+				case ActionNextEpisode:
+					program.Send(countdownChoice(AutoplayContinue))
+				case ActionEpisodeList:
+					program.Send(countdownChoice(AutoplayChoose))
+				case ActionReplay:
+					program.Send(countdownChoice(AutoplayReplay))
+				}
+			}
+		}
+	}()
+
+	if _, err := program.Run(); err != nil {
+		return AutoplayContinue, fmt.Errorf("countdown failed: %w", err)
+	}
+	return model.choice, nil
+}
+
+// ClosePlayer quits a player and waits for it to exit
+func ClosePlayer(player Player) {
+	if err := player.Quit(); err != nil {
+		Debug("Error closing player: %v", err)
+	}
+	for range player.Events() {
+	}
+}
@@ -8,8 +8,18 @@ import (
 	"time"
 )
 
+// Cleanup stops everything buttercup started in the background
+func Cleanup() {
+	if !usingHostStream {
+		CleanupWebtorrent()
+	}
+	StopDlnaServer()
+	StopHlsTranscode()
+	StopStreamServer()
+}
+
 func Exit(msg string, err error) {
-	CleanupWebtorrent()
+	Cleanup()
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Chapter skip modes, used for the config and per-show overrides
+const (
+	ChapterSkipAuto   = "auto"
+	ChapterSkipPrompt = "prompt"
+	ChapterSkipOff    = "off"
+)
+
+// Chapter is an entry of mpv's chapter-list, with the end taken from the next chapter
+type Chapter struct {
+	Title string
+	Start float64
+	End   float64
+}
+
+// ChapterSkipper skips (or offers to skip) chapters like openings and endings as playback reaches them
+type ChapterSkipper struct {
+	client    *MPVClient
+	mode      string
+	key       string
+	chapters  []Chapter
+	handled   map[int]bool
+	prompting int
+}
+
+// ValidChapterSkipMode reports whether mode is one of auto, prompt or off
+func ValidChapterSkipMode(mode string) bool {
+	return mode == ChapterSkipAuto || mode == ChapterSkipPrompt || mode == ChapterSkipOff
+}
+
+// ChapterSkipMode picks the show's own mode over the configured one
+func ChapterSkipMode(config *ProgramConfig, showMode string) string {
+	if ValidChapterSkipMode(showMode) {
+		return showMode
+	}
+	return config.ChapterSkip
+}
+
+// ValidateChapterSkipConfig checks the configured chapter skip mode and patterns
+func ValidateChapterSkipConfig(config *ProgramConfig) error {
+	if !ValidChapterSkipMode(config.ChapterSkip) {
+		return fmt.Errorf("invalid ChapterSkip %q, expected auto, prompt or off", config.ChapterSkip)
+	}
+	if _, err := compileChapterPatterns(config.ChapterSkipPatterns); err != nil {
+		return err
+	}
+	return nil
+}
+
+// compileChapterPatterns parses the comma separated, case-insensitive chapter name patterns
+func compileChapterPatterns(patterns string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chapter pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// MPVChapters reads the chapters of the playing file
+func MPVChapters(client *MPVClient) ([]Chapter, error) {
+	value, err := client.GetProperty("chapter-list")
+	if err != nil {
+		return nil, err
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	duration := 0.0
+	if value, err := client.GetProperty("duration"); err == nil {
+		duration, _ = value.(float64)
+	}
+
+	chapters := make([]Chapter, 0, len(list))
+	for _, item := range list {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		title, _ := entry["title"].(string)
+		start, _ := entry["time"].(float64)
+		chapters = append(chapters, Chapter{Title: title, Start: start, End: duration})
+	}
+	for i := 0; i < len(chapters)-1; i++ {
+		chapters[i].End = chapters[i+1].Start
+	}
+	return chapters, nil
+}
+
+// NewChapterSkipper reads the chapter list and keeps the chapters whose names match the patterns
+func NewChapterSkipper(client *MPVClient, mode string, patterns string, key string) (*ChapterSkipper, error) {
+	compiled, err := compileChapterPatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+	chapters, err := MPVChapters(client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chapters: %w", err)
+	}
+
+	skipper := &ChapterSkipper{
+		client:    client,
+		mode:      mode,
+		key:       key,
+		handled:   make(map[int]bool),
+		prompting: -1,
+	}
+	for _, chapter := range chapters {
+		for _, re := range compiled {
+			if re.MatchString(strings.TrimSpace(chapter.Title)) && chapter.End > chapter.Start {
+				skipper.chapters = append(skipper.chapters, chapter)
+				break
+			}
+		}
+	}
+	Debug("Skippable chapters: %v", skipper.chapters)
+
+	if mode == ChapterSkipPrompt && len(skipper.chapters) > 0 {
+		if err := client.BindKey(key, "skip-chapter"); err != nil {
+			return nil, fmt.Errorf("failed to bind %s: %w", key, err)
+		}
+	}
+	return skipper, nil
+}
+
+// Update skips or announces a matching chapter once playback enters it
+func (s *ChapterSkipper) Update(position float64) {
+	if s.mode == ChapterSkipOff {
+		return
+	}
+	for i, chapter := range s.chapters {
+		if position < chapter.Start || position >= chapter.End {
+			continue
+		}
+		if s.handled[i] {
+			return
+		}
+		s.handled[i] = true
+
+		if s.mode == ChapterSkipAuto {
+			s.skip(i)
+			return
+		}
+		s.prompting = i
+		s.client.ShowText(fmt.Sprintf("%s – press %s to skip", chapter.Title, s.key), 5*time.Second)
+		return
+	}
+	s.prompting = -1
+}
+
+// HandleMessage handles the skip key of the prompt, returning false for other messages
+func (s *ChapterSkipper) HandleMessage(args []string) bool {
+	if len(args) < 2 || args[0] != "buttercup" || args[1] != "skip-chapter" {
+		return false
+	}
+	if s.prompting >= 0 {
+		s.skip(s.prompting)
+		s.prompting = -1
+	}
+	return true
+}
+
+func (s *ChapterSkipper) skip(i int) {
+	chapter := s.chapters[i]
+	Debug("Skipping chapter %q to %.1f", chapter.Title, chapter.End)
+	if _, err := s.client.Command("seek", chapter.End, "absolute"); err != nil {
+		Debug("Error skipping chapter: %v", err)
+		return
+	}
+	s.client.ShowText("Skipped "+chapter.Title, 2*time.Second)
+}
@@ -20,6 +20,47 @@ type ProgramConfig struct {
 	RofiSelection bool `config:"RofiSelection"`
 	PercentageToMarkCompleted int `config:"PercentageToMarkCompleted"`
 	SaveMpvSpeed bool `config:"SaveMpvSpeed"`
+	DlnaPort string `config:"DlnaPort"`
+	DlnaName string `config:"DlnaName"`
+	FfmpegPath string `config:"FfmpegPath"`
+	HlsPort string `config:"HlsPort"`
+	HlsJsPath string `config:"HlsJsPath"`
+	ServePort string `config:"ServePort"`
+	Player string `config:"Player"`
+	VlcPath string `config:"VlcPath"`
+	PlayerCommand string `config:"PlayerCommand"`
+	MpvPath string `config:"MpvPath"`
+	MpvArgs string `config:"MpvArgs"`
+	MpvProfile string `config:"MpvProfile"`
+	ChapterSkip string `config:"ChapterSkip"`
+	ChapterSkipPatterns string `config:"ChapterSkipPatterns"`
+	ChapterSkipKey string `config:"ChapterSkipKey"`
+	IntroMarkKey string `config:"IntroMarkKey"`
+	OutroMarkKey string `config:"OutroMarkKey"`
+	SkipSegmentTolerance int `config:"SkipSegmentTolerance"`
+	NextEpisodeKey string `config:"NextEpisodeKey"`
+	PreviousEpisodeKey string `config:"PreviousEpisodeKey"`
+	MarkWatchedKey string `config:"MarkWatchedKey"`
+	EpisodeListKey string `config:"EpisodeListKey"`
+	StopAfterEpisodeKey string `config:"StopAfterEpisodeKey"`
+	SleepTimerKey string `config:"SleepTimerKey"`
+	ReplayKey string `config:"ReplayKey"`
+	Autoplay bool `config:"Autoplay"`
+	AutoplayCountdown int `config:"AutoplayCountdown"`
+	MpvPlaylist bool `config:"MpvPlaylist"`
+	HistoryBackups int `config:"HistoryBackups"`
+	PreferredAudioLanguages string `config:"PreferredAudioLanguages"`
+	PreferredSubtitleLanguages string `config:"PreferredSubtitleLanguages"`
+	ForcedSubtitlesOnly bool `config:"ForcedSubtitlesOnly"`
+	WatchPartyTolerance int `config:"WatchPartyTolerance"`
+	WatchPartySecret string `config:"WatchPartySecret"`
+	AnilistSync bool `config:"AnilistSync"`
+	AnilistClientID string `config:"AnilistClientID"`
+	AnilistApiUrl string `config:"AnilistApiUrl"`
+	TraktScrobble bool `config:"TraktScrobble"`
+	TraktClientID string `config:"TraktClientID"`
+	TraktClientSecret string `config:"TraktClientSecret"`
+	TraktApiUrl string `config:"TraktApiUrl"`
 }
 
 // Default configuration values as a map
@@ -33,6 +74,47 @@ func defaultConfigMap() map[string]string {
 		"RofiSelection":           "false",
 		"PercentageToMarkCompleted":	"92",
 		"SaveMpvSpeed":				"false",
+		"DlnaPort":				"8200",
+		"DlnaName":				"buttercup",
+		"FfmpegPath":				"ffmpeg",
+		"HlsPort":				"8300",
+		"HlsJsPath":				"",
+		"ServePort":				"8400",
+		"Player":				"mpv",
+		"VlcPath":				"vlc",
+		"PlayerCommand":			"",
+		"MpvPath":				"mpv",
+		"MpvArgs":				"--cache=yes --cache-secs=10 --demuxer-max-bytes=50M --demuxer-readahead-secs=5 --really-quiet",
+		"MpvProfile":				"",
+		"ChapterSkip":				"off",
+		"ChapterSkipPatterns":		`^(op|ed)\d*$,opening,ending,^intro$,^outro$`,
+		"ChapterSkipKey":			"ctrl+x",
+		"IntroMarkKey":				"ctrl+i",
+		"OutroMarkKey":				"ctrl+o",
+		"SkipSegmentTolerance":		"5",
+		"NextEpisodeKey":			"ctrl+n",
+		"PreviousEpisodeKey":		"ctrl+p",
+		"MarkWatchedKey":			"ctrl+d",
+		"EpisodeListKey":			"ctrl+l",
+		"StopAfterEpisodeKey":		"ctrl+e",
+		"SleepTimerKey":			"ctrl+t",
+		"ReplayKey":			"ctrl+r",
+		"Autoplay":			"false",
+		"AutoplayCountdown":		"10",
+		"MpvPlaylist":			"false",
+		"HistoryBackups":		"5",
+		"PreferredAudioLanguages":	"",
+		"PreferredSubtitleLanguages":	"",
+		"ForcedSubtitlesOnly":		"false",
+		"WatchPartyTolerance":		"2",
+		"WatchPartySecret":		"",
+		"AnilistSync":			"false",
+		"AnilistClientID":		"",
+		"AnilistApiUrl":		"https://graphql.anilist.co",
+		"TraktScrobble":		"false",
+		"TraktClientID":		"",
+		"TraktClientSecret":		"",
+		"TraktApiUrl":			"https://api.trakt.tv",
 	}
 }
 
@@ -140,21 +222,12 @@ func createDefaultConfig(path string) error {
 		return fmt.Errorf("error creating directory: %v", err)
 	}
 
-	file, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("error creating file: %v", err)
-	}
-	defer file.Close()
-
-	writer := bufio.NewWriter(file)
+	var content strings.Builder
 	for key, value := range defaultConfig {
-		line := fmt.Sprintf("%s=%s\n", key, value)
-		if _, err := writer.WriteString(line); err != nil {
-			return fmt.Errorf("error writing to file: %v", err)
-		}
+		content.WriteString(fmt.Sprintf("%s=%s\n", key, value))
 	}
-	if err := writer.Flush(); err != nil {
-		return fmt.Errorf("error flushing writer: %v", err)
+	if err := WriteFileAtomic(path, []byte(content.String()), 0600); err != nil {
+		return fmt.Errorf("error creating file: %v", err)
 	}
 	return nil
 }
@@ -193,20 +266,11 @@ func loadConfigFromFile(path string) (map[string]string, error) {
 
 // Save updated config map to file in key=value format
 func saveConfigToFile(path string, configMap map[string]string) error {
-	file, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	writer := bufio.NewWriter(file)
+	var content strings.Builder
 	for key, value := range configMap {
-		line := fmt.Sprintf("%s=%s\n", key, value)
-		if _, err := writer.WriteString(line); err != nil {
-			return err
-		}
+		content.WriteString(fmt.Sprintf("%s=%s\n", key, value))
 	}
-	return writer.Flush()
+	return WriteFileAtomic(path, []byte(content.String()), 0600)
 }
 
 // Populate the ProgramConfig struct from a map
@@ -0,0 +1,686 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const (
+	ssdpAddress          = "239.255.255.250:1900"
+	ssdpMaxAge           = 1800
+	dlnaDeviceType       = "urn:schemas-upnp-org:device:MediaServer:1"
+	dlnaContentDirectory = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	dlnaConnectionMgr    = "urn:schemas-upnp-org:service:ConnectionManager:1"
+	dlnaStreamingFlags   = "DLNA.ORG_OP=01;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=01700000000000000000000000000000"
+)
+
+var currentDlnaServer *DlnaServer
+
+// DlnaServer is a UPnP MediaServer that exposes the current stream and the watch history on the LAN
+type DlnaServer struct {
+	Name         string
+	Port         int
+	DatabaseFile string
+
+	udn      string
+	ip       string
+	http     *http.Server
+	ssdp     *net.UDPConn
+	done     chan struct{}
+	updateID int
+
+	mu         sync.Mutex
+	nowPlaying *dlnaItem
+	active     *dlnaItem
+
+	// startMu makes requests that arrive together wait for one stream instead of each starting one
+	startMu sync.Mutex
+}
+
+// dlnaItem is a video listed in the content directory
+type dlnaItem struct {
+	ID        string
+	Title     string
+	MagnetURI string
+	FileIndex int
+	StreamURL string
+	Files     []TorrentFileInfo
+	Completed bool
+	progress  *streamProgress
+}
+
+// StartDlnaServer starts advertising buttercup as a media server on the local network
+func StartDlnaServer(databaseFile string) (*DlnaServer, error) {
+	config := GetGlobalConfig()
+
+	port, err := strconv.Atoi(config.DlnaPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DLNA port %q: %w", config.DlnaPort, err)
+	}
+
+	ip, err := lanIP()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find LAN address: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	sum := md5.Sum([]byte(hostname + config.DlnaName))
+	server := &DlnaServer{
+		Name:         config.DlnaName,
+		Port:         port,
+		DatabaseFile: databaseFile,
+		udn:          fmt.Sprintf("uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16]),
+		ip:           ip,
+		done:         make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", server.handleDescription)
+	mux.HandleFunc("/ContentDirectory.xml", server.handleStaticXML(contentDirectorySCPD))
+	mux.HandleFunc("/ConnectionManager.xml", server.handleStaticXML(connectionManagerSCPD))
+	mux.HandleFunc("/ctl/ContentDirectory", server.handleContentDirectory)
+	mux.HandleFunc("/ctl/ConnectionManager", server.handleConnectionManager)
+	mux.HandleFunc("/media/", server.handleMedia)
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on port %d: %w", port, err)
+	}
+	server.http = &http.Server{Handler: mux}
+	go server.http.Serve(listener)
+
+	multicastAddr, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return nil, err
+	}
+	server.ssdp, err = net.ListenMulticastUDP("udp4", nil, multicastAddr)
+	if err != nil {
+		server.http.Close()
+		return nil, fmt.Errorf("failed to join SSDP multicast group: %w", err)
+	}
+	go server.serveSSDP()
+	go server.advertise()
+
+	currentDlnaServer = server
+	Debug("DLNA server %s listening on http://%s:%d/rootDesc.xml", server.udn, ip, port)
+	return server, nil
+}
+
+// StopDlnaServer announces that the media server is leaving and shuts it down
+func StopDlnaServer() {
+	if currentDlnaServer == nil {
+		return
+	}
+	server := currentDlnaServer
+	currentDlnaServer = nil
+
+	close(server.done)
+	server.notify("ssdp:byebye")
+	server.ssdp.Close()
+	server.http.Close()
+}
+
+// publishNowPlaying lists the stream that is currently playing in the content directory
+func publishNowPlaying(title string, streamURL string) {
+	server := currentDlnaServer
+	if server == nil {
+		return
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.nowPlaying = &dlnaItem{ID: "now/0", Title: title, StreamURL: streamURL}
+	server.updateID++
+}
+
+// forgetDlnaStream drops the stream started for a renderer once webtorrent no longer serves it
+func forgetDlnaStream() {
+	server := currentDlnaServer
+	if server == nil {
+		return
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.active = nil
+}
+
+// lanIP returns the address other devices on the network can reach us on
+func lanIP() (string, error) {
+	conn, err := net.Dial("udp4", ssdpAddress)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+func (s *DlnaServer) baseURL() string {
+	return fmt.Sprintf("http://%s:%d", s.ip, s.Port)
+}
+
+// notificationTypes are the targets announced over SSDP, paired with their unique service names
+func (s *DlnaServer) notificationTypes() [][2]string {
+	return [][2]string{
+		{"upnp:rootdevice", s.udn + "::upnp:rootdevice"},
+		{s.udn, s.udn},
+		{dlnaDeviceType, s.udn + "::" + dlnaDeviceType},
+		{dlnaContentDirectory, s.udn + "::" + dlnaContentDirectory},
+		{dlnaConnectionMgr, s.udn + "::" + dlnaConnectionMgr},
+	}
+}
+
+// advertise sends ssdp:alive notifications until the server stops
+func (s *DlnaServer) advertise() {
+	ticker := time.NewTicker(ssdpMaxAge / 2 * time.Second)
+	defer ticker.Stop()
+
+	s.notify("ssdp:alive")
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.notify("ssdp:alive")
+		}
+	}
+}
+
+func (s *DlnaServer) notify(nts string) {
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return
+	}
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		Debug("Failed to send SSDP notify: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	for _, target := range s.notificationTypes() {
+		message := "NOTIFY * HTTP/1.1\r\n" +
+			"HOST: " + ssdpAddress + "\r\n" +
+			fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", ssdpMaxAge) +
+			"LOCATION: " + s.baseURL() + "/rootDesc.xml\r\n" +
+			"NT: " + target[0] + "\r\n" +
+			"NTS: " + nts + "\r\n" +
+			"SERVER: Linux UPnP/1.0 buttercup/1.0\r\n" +
+			"USN: " + target[1] + "\r\n\r\n"
+		conn.Write([]byte(message))
+	}
+}
+
+// serveSSDP answers M-SEARCH discovery requests
+func (s *DlnaServer) serveSSDP() {
+	buf := make([]byte, 2048)
+	for {
+		n, src, err := s.ssdp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("MAN") != `"ssdp:discover"` {
+			continue
+		}
+
+		searchTarget := req.Header.Get("ST")
+		for _, target := range s.notificationTypes() {
+			if searchTarget != "ssdp:all" && searchTarget != target[0] {
+				continue
+			}
+			go s.respondSearch(src, target[0], target[1])
+		}
+	}
+}
+
+func (s *DlnaServer) respondSearch(dst *net.UDPAddr, searchTarget string, usn string) {
+	// Spread responses a little as required by the spec
+	time.Sleep(time.Duration(rand.Intn(500)) * time.Millisecond)
+
+	conn, err := net.DialUDP("udp4", nil, dst)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	message := "HTTP/1.1 200 OK\r\n" +
+		fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", ssdpMaxAge) +
+		"DATE: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n" +
+		"EXT:\r\n" +
+		"LOCATION: " + s.baseURL() + "/rootDesc.xml\r\n" +
+		"SERVER: Linux UPnP/1.0 buttercup/1.0\r\n" +
+		"ST: " + searchTarget + "\r\n" +
+		"USN: " + usn + "\r\n\r\n"
+	conn.Write([]byte(message))
+}
+
+func (s *DlnaServer) handleDescription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>%s</deviceType>
+    <friendlyName>%s</friendlyName>
+    <manufacturer>buttercup</manufacturer>
+    <modelName>buttercup</modelName>
+    <UDN>%s</UDN>
+    <serviceList>
+      <service>
+        <serviceType>%s</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId>
+        <SCPDURL>/ContentDirectory.xml</SCPDURL>
+        <controlURL>/ctl/ContentDirectory</controlURL>
+        <eventSubURL>/evt/ContentDirectory</eventSubURL>
+      </service>
+      <service>
+        <serviceType>%s</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId>
+        <SCPDURL>/ConnectionManager.xml</SCPDURL>
+        <controlURL>/ctl/ConnectionManager</controlURL>
+        <eventSubURL>/evt/ConnectionManager</eventSubURL>
+      </service>
+    </serviceList>
+  </device>
+</root>`, dlnaDeviceType, xmlEscape(s.Name), s.udn, dlnaContentDirectory, dlnaConnectionMgr)
+}
+
+func (s *DlnaServer) handleStaticXML(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		io.WriteString(w, body)
+	}
+}
+
+// soapAction returns the action name from a SOAPACTION header like "urn:...:1#Browse"
+func soapAction(r *http.Request) string {
+	action := strings.Trim(r.Header.Get("SOAPACTION"), `"`)
+	if i := strings.LastIndex(action, "#"); i >= 0 {
+		return action[i+1:]
+	}
+	return action
+}
+
+func writeSOAPResponse(w http.ResponseWriter, service string, action string, values [][2]string) {
+	var body strings.Builder
+	for _, value := range values {
+		fmt.Fprintf(&body, "<%s>%s</%s>", value[0], xmlEscape(value[1]), value[0])
+	}
+
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body>
+</s:Envelope>`, action, service, body.String(), action)
+}
+
+func (s *DlnaServer) handleConnectionManager(w http.ResponseWriter, r *http.Request) {
+	switch soapAction(r) {
+	case "GetProtocolInfo":
+		writeSOAPResponse(w, dlnaConnectionMgr, "GetProtocolInfo", [][2]string{
+			{"Source", "http-get:*:video/x-matroska:*,http-get:*:video/mp4:*,http-get:*:video/x-msvideo:*,http-get:*:video/webm:*"},
+			{"Sink", ""},
+		})
+	default:
+		http.Error(w, "unsupported action", http.StatusInternalServerError)
+	}
+}
+
+func (s *DlnaServer) handleContentDirectory(w http.ResponseWriter, r *http.Request) {
+	switch soapAction(r) {
+	case "GetSearchCapabilities":
+		writeSOAPResponse(w, dlnaContentDirectory, "GetSearchCapabilities", [][2]string{{"SearchCaps", ""}})
+	case "GetSortCapabilities":
+		writeSOAPResponse(w, dlnaContentDirectory, "GetSortCapabilities", [][2]string{{"SortCaps", ""}})
+	case "GetSystemUpdateID":
+		s.mu.Lock()
+		id := s.updateID
+		s.mu.Unlock()
+		writeSOAPResponse(w, dlnaContentDirectory, "GetSystemUpdateID", [][2]string{{"Id", strconv.Itoa(id)}})
+	case "Browse":
+		s.handleBrowse(w, r)
+	default:
+		http.Error(w, "unsupported action", http.StatusInternalServerError)
+	}
+}
+
+func (s *DlnaServer) handleBrowse(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ObjectID       string `xml:"Body>Browse>ObjectID"`
+		BrowseFlag     string `xml:"Body>Browse>BrowseFlag"`
+		StartingIndex  int    `xml:"Body>Browse>StartingIndex"`
+		RequestedCount int    `xml:"Body>Browse>RequestedCount"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var objects []string
+	total := 0
+	if request.BrowseFlag == "BrowseMetadata" {
+		objects = append(objects, s.didlObject(request.ObjectID))
+		total = 1
+	} else {
+		children := s.children(request.ObjectID)
+		total = len(children)
+		if request.RequestedCount < 0 {
+			http.Error(w, "invalid RequestedCount", http.StatusBadRequest)
+			return
+		}
+		start := request.StartingIndex
+		if start < 0 {
+			start = 0
+		}
+		if start > len(children) {
+			start = len(children)
+		}
+		end := len(children)
+		if request.RequestedCount > 0 && start+request.RequestedCount < end {
+			end = start + request.RequestedCount
+		}
+		objects = children[start:end]
+	}
+
+	result := `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">` +
+		strings.Join(objects, "") + `</DIDL-Lite>`
+
+	s.mu.Lock()
+	updateID := s.updateID
+	s.mu.Unlock()
+	writeSOAPResponse(w, dlnaContentDirectory, "Browse", [][2]string{
+		{"Result", result},
+		{"NumberReturned", strconv.Itoa(len(objects))},
+		{"TotalMatches", strconv.Itoa(total)},
+		{"UpdateID", strconv.Itoa(updateID)},
+	})
+}
+
+// historyItems lists the watch history as content directory items
+func (s *DlnaServer) historyItems() []dlnaItem {
+	var items []dlnaItem
+	for _, torrent := range LocalGetAllTorrents(s.DatabaseFile) {
+		items = append(items, dlnaItem{
+			ID:        "history/" + dlnaHistoryID(torrent.MagnetURI),
+			Title:     torrent.DisplayTitle(),
+			MagnetURI: torrent.MagnetURI,
+			FileIndex: torrent.FileIndex,
+		})
+	}
+	return items
+}
+
+// dlnaHistoryID identifies a show by its info hash, so a TV keeps playing the same show when the history changes
+func dlnaHistoryID(magnetURI string) string {
+	if magnet, err := metainfo.ParseMagnetUri(magnetURI); err == nil {
+		return magnet.InfoHash.HexString()
+	}
+	return fmt.Sprintf("%x", md5.Sum([]byte(magnetURI)))
+}
+
+func (s *DlnaServer) children(objectID string) []string {
+	var objects []string
+	switch objectID {
+	case "0":
+		objects = append(objects,
+			didlContainer("now", "0", "Now Playing", len(s.children("now"))),
+			didlContainer("history", "0", "Continue Watching", len(s.historyItems())))
+	case "now":
+		s.mu.Lock()
+		nowPlaying := s.nowPlaying
+		s.mu.Unlock()
+		if nowPlaying != nil {
+			objects = append(objects, s.didlItem(*nowPlaying, "now"))
+		}
+	case "history":
+		for _, item := range s.historyItems() {
+			objects = append(objects, s.didlItem(item, "history"))
+		}
+	}
+	return objects
+}
+
+func (s *DlnaServer) didlObject(objectID string) string {
+	switch objectID {
+	case "0":
+		return `<container id="0" parentID="-1" restricted="1" searchable="0"><dc:title>` + xmlEscape(s.Name) + `</dc:title><upnp:class>object.container.storageFolder</upnp:class></container>`
+	case "now", "history":
+		children := s.children(objectID)
+		title := "Now Playing"
+		if objectID == "history" {
+			title = "Continue Watching"
+		}
+		return didlContainer(objectID, "0", title, len(children))
+	}
+	if item, ok := s.findItem(objectID); ok {
+		return s.didlItem(item, path.Dir(objectID))
+	}
+	return ""
+}
+
+func didlContainer(id string, parentID string, title string, childCount int) string {
+	return fmt.Sprintf(`<container id="%s" parentID="%s" restricted="1" searchable="0" childCount="%d"><dc:title>%s</dc:title><upnp:class>object.container.storageFolder</upnp:class></container>`,
+		id, parentID, childCount, xmlEscape(title))
+}
+
+func (s *DlnaServer) didlItem(item dlnaItem, parentID string) string {
+	mimeType := videoMimeType(item.Title)
+	return fmt.Sprintf(`<item id="%s" parentID="%s" restricted="1"><dc:title>%s</dc:title><upnp:class>object.item.videoItem</upnp:class><res protocolInfo="http-get:*:%s:%s">%s/media/%s</res></item>`,
+		item.ID, parentID, xmlEscape(item.Title), mimeType, dlnaStreamingFlags, s.baseURL(), item.ID)
+}
+
+// videoMimeType guesses the MIME type from a display name like "show.mkv (1.2 GB)"
+func videoMimeType(name string) string {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".mkv", ".mp4", ".m4v", ".avi", ".webm", ".mov", ".wmv", ".flv", ".mpg", ".mpeg", ".3gp"} {
+		if strings.Contains(name, ext) {
+			if ext == ".mkv" {
+				return "video/x-matroska"
+			}
+			if mimeType := mime.TypeByExtension(ext); mimeType != "" {
+				return mimeType
+			}
+		}
+	}
+	return "video/x-matroska"
+}
+
+func (s *DlnaServer) findItem(id string) (dlnaItem, bool) {
+	if id == "now/0" {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.nowPlaying != nil {
+			return *s.nowPlaying, true
+		}
+		return dlnaItem{}, false
+	}
+	for _, item := range s.historyItems() {
+		if item.ID == id {
+			return item, true
+		}
+	}
+	return dlnaItem{}, false
+}
+
+// resolve starts streaming a history item, reusing the active stream when it is the same file.
+// Starting one stops the stream webtorrent is serving, so it is refused while buttercup is playing locally.
+func (s *DlnaServer) resolve(item dlnaItem) (*dlnaItem, error) {
+	if item.StreamURL != "" {
+		return &item, nil
+	}
+
+	s.startMu.Lock()
+	defer s.startMu.Unlock()
+	if active := s.activeItem(item); active != nil {
+		return active, nil
+	}
+	if CurrentStreamURL() != "" {
+		return nil, fmt.Errorf("buttercup is playing locally, pick Now Playing instead")
+	}
+
+	files, err := GetTorrentFiles(item.MagnetURI)
+	if err != nil {
+		return nil, err
+	}
+	item.Files = files
+	watching := Torrent{Files: files, FileIndex: item.FileIndex}
+	file, ok := watching.CurrentFile()
+	if !ok {
+		return nil, fmt.Errorf("file %d is no longer in the torrent", item.FileIndex)
+	}
+	item.FileIndex = file.ActualIndex
+	item.progress = &streamProgress{}
+
+	item.StreamURL, err = startStream(item.MagnetURI, file)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active = &item
+	return s.active, nil
+}
+
+// activeItem returns the active stream when it is the file of item
+func (s *DlnaServer) activeItem(item dlnaItem) *dlnaItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active != nil && s.active.MagnetURI == item.MagnetURI && s.active.FileIndex == item.FileIndex {
+		return s.active
+	}
+	return nil
+}
+
+func (s *DlnaServer) handleMedia(w http.ResponseWriter, r *http.Request) {
+	found, ok := s.findItem(strings.TrimPrefix(r.URL.Path, "/media/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	item, err := s.resolve(found)
+	if err != nil {
+		Debug("Failed to start DLNA stream for %s: %v", found.Title, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	percentage := proxyStream(w, r, item.StreamURL, videoMimeType(item.Title), map[string]string{
+		"transferMode.dlna.org":    "Streaming",
+		"contentFeatures.dlna.org": dlnaStreamingFlags,
+	}, item.progress)
+	if item.MagnetURI != "" && percentage >= 0 {
+		s.trackProgress(item, percentage)
+	}
+}
+
+// trackProgress moves the history entry to the next episode once a TV has streamed most of a file
+func (s *DlnaServer) trackProgress(item *dlnaItem, percentage float64) {
+	Debug("DLNA client streamed %.1f%% of %s", percentage, item.Title)
+
+	config := GetGlobalConfig()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if item.Completed || percentage < float64(config.PercentageToMarkCompleted) {
+		return
+	}
+	item.Completed = true
+
+	if err := LocalUpdateEpisode(s.DatabaseFile, item.MagnetURI, item.FileIndex, 0, 0, true); err != nil {
+		Debug("Error updating episode history after DLNA playback: %v", err)
+	}
+	if next, ok := NextEpisode(item.Files, item.FileIndex); ok {
+		if err := LocalUpdateTorrent(s.DatabaseFile, item.MagnetURI, next.ActualIndex, 0, next.DisplayName); err != nil {
+			Debug("Error updating database after DLNA playback: %v", err)
+		}
+	}
+}
+
+func xmlEscape(value string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(value))
+	return buf.String()
+}
+
+const contentDirectorySCPD = `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action>
+      <name>Browse</name>
+      <argumentList>
+        <argument><name>ObjectID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+        <argument><name>BrowseFlag</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_BrowseFlag</relatedStateVariable></argument>
+        <argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+        <argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+        <argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+        <argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+        <argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+    <action>
+      <name>GetSearchCapabilities</name>
+      <argumentList><argument><name>SearchCaps</name><direction>out</direction><relatedStateVariable>SearchCapabilities</relatedStateVariable></argument></argumentList>
+    </action>
+    <action>
+      <name>GetSortCapabilities</name>
+      <argumentList><argument><name>SortCaps</name><direction>out</direction><relatedStateVariable>SortCapabilities</relatedStateVariable></argument></argumentList>
+    </action>
+    <action>
+      <name>GetSystemUpdateID</name>
+      <argumentList><argument><name>Id</name><direction>out</direction><relatedStateVariable>SystemUpdateID</relatedStateVariable></argument></argumentList>
+    </action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ObjectID</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Result</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_BrowseFlag</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>BrowseMetadata</allowedValue><allowedValue>BrowseDirectChildren</allowedValue></allowedValueList>
+    </stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Filter</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_SortCriteria</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Index</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Count</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_UpdateID</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SearchCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SortCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SystemUpdateID</name><dataType>ui4</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>`
+
+const connectionManagerSCPD = `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action>
+      <name>GetProtocolInfo</name>
+      <argumentList>
+        <argument><name>Source</name><direction>out</direction><relatedStateVariable>SourceProtocolInfo</relatedStateVariable></argument>
+        <argument><name>Sink</name><direction>out</direction><relatedStateVariable>SinkProtocolInfo</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="yes"><name>SourceProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SinkProtocolInfo</name><dataType>string</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>`
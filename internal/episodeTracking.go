@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EpisodeProgress is the playback state of a single file of a torrent
+type EpisodeProgress struct {
+	MagnetURI    string
+	FileIndex    int
+	PlaybackTime int
+	Duration     int
+	Watched      bool
+	LastWatched  time.Time
+}
+
+// Percentage returns how much of the episode has been played
+func (e EpisodeProgress) Percentage() float64 {
+	if e.Watched {
+		return 100
+	}
+	return PercentageWatched(e.PlaybackTime, e.Duration)
+}
+
+// LocalGetAllEpisodes reads the progress of every episode that has been played
+func LocalGetAllEpisodes(databaseFile string) []EpisodeProgress {
+	return queryEpisodes(databaseFile, "")
+}
+
+// LocalGetShowEpisodes returns the progress of a torrent's episodes by file index
+func LocalGetShowEpisodes(databaseFile string, magnetURI string) map[int]EpisodeProgress {
+	episodes := make(map[int]EpisodeProgress)
+	for _, episode := range queryEpisodes(databaseFile, "WHERE magnet_uri = ?", magnetURI) {
+		episodes[episode.FileIndex] = episode
+	}
+	return episodes
+}
+
+func queryEpisodes(databaseFile string, where string, args ...interface{}) []EpisodeProgress {
+	episodes := []EpisodeProgress{}
+
+	db, err := openWatchDatabase(databaseFile)
+	if err != nil {
+		Output(fmt.Sprintf("Error opening watch database: %v", err))
+		return episodes
+	}
+	rows, err := db.Query("SELECT magnet_uri, file_index, playback_time, duration, watched, last_watched FROM files "+where+" ORDER BY rowid", args...)
+	if err != nil {
+		Output(fmt.Sprintf("Error reading episode history: %v", err))
+		return episodes
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var episode EpisodeProgress
+		var lastWatched int64
+		err := rows.Scan(&episode.MagnetURI, &episode.FileIndex, &episode.PlaybackTime, &episode.Duration, &episode.Watched, &lastWatched)
+		if err != nil {
+			Output(fmt.Sprintf("Error reading episode history: %v", err))
+			return episodes
+		}
+		episode.LastWatched = time.Unix(lastWatched, 0)
+		episodes = append(episodes, episode)
+	}
+	return episodes
+}
+
+// LocalUpdateEpisode saves the progress of one episode. A watched episode stays watched when rewatched,
+// and a zero duration keeps the known one.
+func LocalUpdateEpisode(databaseFile string, magnetURI string, fileIndex int, playbackTime int, duration int, watched bool) error {
+	db, err := openWatchDatabase(databaseFile)
+	if err != nil {
+		return err
+	}
+
+	// Other instances could change the entry between reading and writing it
+	unlock, err := LockFile(databaseFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	episode := EpisodeProgress{MagnetURI: magnetURI, FileIndex: fileIndex}
+	if existing := queryEpisodes(databaseFile, "WHERE magnet_uri = ? AND file_index = ?", magnetURI, fileIndex); len(existing) > 0 {
+		episode = existing[0]
+	}
+	episode.PlaybackTime = playbackTime
+	if duration > 0 {
+		episode.Duration = duration
+	}
+	episode.Watched = episode.Watched || watched
+	episode.LastWatched = time.Now()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := saveEpisode(tx, episode); err != nil {
+		return fmt.Errorf("error saving episode: %w", err)
+	}
+	return tx.Commit()
+}
+
+// ProgressLabel describes where a show is at for the Continue Watching list, e.g. "Ep 7/12 – 43%"
+func ProgressLabel(torrent TorrentData, episodes map[int]EpisodeProgress) string {
+	if torrent.FileIndex == NotStartedFileIndex {
+		return "Not started"
+	}
+	// The list shows the episode title unless the show was renamed
+	var parts []string
+	if episode, ok := EpisodeNumber(displayFileName(torrent.Title)); ok {
+		label := fmt.Sprintf("Ep %d", episode)
+		if torrent.EpisodeCount > 0 {
+			label += fmt.Sprintf("/%d", torrent.EpisodeCount)
+		}
+		parts = append(parts, label)
+	} else if torrent.ShowTitle != "" {
+		parts = append(parts, torrent.Title)
+	}
+	if progress, ok := episodes[torrent.FileIndex]; ok && (progress.Duration > 0 || progress.Watched) {
+		parts = append(parts, fmt.Sprintf("%.0f%%", progress.Percentage()))
+	}
+	if len(parts) == 0 {
+		return "Started"
+	}
+	return strings.Join(parts, " – ")
+}
@@ -0,0 +1,21 @@
+package internal
+
+import "testing"
+
+func TestProgressLabel(t *testing.T) {
+	episodes := map[int]EpisodeProgress{4: {PlaybackTime: 600, Duration: 1400}}
+	for _, test := range []struct {
+		torrent TorrentData
+		want    string
+	}{
+		{TorrentData{FileIndex: NotStartedFileIndex}, "Not started"},
+		{TorrentData{FileIndex: 4, Title: "Show.S01E05.mkv (1.2 GB)", EpisodeCount: 12}, "Ep 5/12 – 43%"},
+		// The folder of a batch names the range of episodes, only the file name has the episode
+		{TorrentData{FileIndex: 4, Title: "[Group] Frieren - 01-28 (Batch)/[Group] Frieren - 05 [1920x1080].mkv (1.4 GB)"}, "Ep 5 – 43%"},
+		{TorrentData{FileIndex: 1, Title: "Movie.2020.mkv (4 GB)"}, "Started"},
+	} {
+		if got := ProgressLabel(test.torrent, episodes); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.torrent.Title, got, test.want)
+		}
+	}
+}
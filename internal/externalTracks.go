@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// languageAliases maps the language hints found in release file names to ISO 639-2 codes
+var languageAliases = map[string]string{
+	"en": "eng", "eng": "eng", "english": "eng",
+	"ja": "jpn", "jp": "jpn", "jpn": "jpn", "japanese": "jpn",
+	"es": "spa", "spa": "spa", "esp": "spa", "spanish": "spa", "latino": "spa",
+	"pt": "por", "por": "por", "portuguese": "por", "ptbr": "por", "brazilian": "por",
+	"fr": "fre", "fre": "fre", "fra": "fre", "french": "fre",
+	"de": "ger", "ger": "ger", "deu": "ger", "german": "ger",
+	"it": "ita", "ita": "ita", "italian": "ita",
+	"ru": "rus", "rus": "rus", "russian": "rus",
+	"ar": "ara", "ara": "ara", "arabic": "ara",
+	"zh": "chi", "chi": "chi", "zho": "chi", "chs": "chi", "cht": "chi", "chinese": "chi",
+	"ko": "kor", "kor": "kor", "korean": "kor",
+	"pl": "pol", "pol": "pol", "polish": "pol",
+	"nl": "dut", "dut": "dut", "nld": "dut", "dutch": "dut",
+	"tr": "tur", "tur": "tur", "turkish": "tur",
+	"id": "ind", "ind": "ind", "indonesian": "ind",
+	"vi": "vie", "vie": "vie", "vietnamese": "vie",
+	"th": "tha", "tha": "tha", "thai": "tha",
+	"hi": "hin", "hin": "hin", "hindi": "hin",
+	"sv": "swe", "swe": "swe", "swedish": "swe",
+}
+
+var languageWordRegex = regexp.MustCompile(`[a-z]+`)
+
+// NormalizeLanguage converts a language code or name to its ISO 639-2 form, or returns it lowercased if unknown
+func NormalizeLanguage(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if code, ok := languageAliases[strings.ReplaceAll(lang, "-", "")]; ok {
+		return code
+	}
+	return lang
+}
+
+// ParseLanguageList turns a comma separated list of languages from the config into ISO 639-2 codes
+func ParseLanguageList(value string) []string {
+	var languages []string
+	for _, lang := range strings.Split(value, ",") {
+		if lang = NormalizeLanguage(lang); lang != "" {
+			languages = append(languages, lang)
+		}
+	}
+	return languages
+}
+
+// mpvLanguageOption formats languages for --alang/--slang, adding the two letter codes
+// since tracks are tagged with either
+func mpvLanguageOption(languages []string) string {
+	var codes []string
+	for _, lang := range languages {
+		var aliases []string
+		for alias, code := range languageAliases {
+			if code == lang && len(alias) == 2 {
+				aliases = append(aliases, alias)
+			}
+		}
+		sort.Strings(aliases)
+		codes = append(append(codes, lang), aliases...)
+	}
+	return strings.Join(codes, ",")
+}
+
+// DetectLanguage guesses the language of a sidecar file from its name and folders
+func DetectLanguage(filePath string) string {
+	lower := strings.ToLower(filePath)
+	base := strings.TrimSuffix(path.Base(lower), path.Ext(lower))
+
+	// Dot separated suffixes like "Episode 01.en.forced.ass" are the most reliable hint
+	segments := strings.Split(base, ".")
+	for i := len(segments) - 1; i > 0; i-- {
+		if lang, ok := languageAliases[strings.ReplaceAll(segments[i], "-", "")]; ok {
+			return lang
+		}
+	}
+
+	// Fall back to whole words in the file name and its folders, e.g. "Subs/English/01.ass"
+	candidates := []string{base}
+	dirs := strings.Split(path.Dir(lower), "/")
+	for i := len(dirs) - 1; i >= 0; i-- {
+		candidates = append(candidates, dirs[i])
+	}
+	for _, candidate := range candidates {
+		for _, word := range languageWordRegex.FindAllString(candidate, -1) {
+			// Two letter codes are too ambiguous outside of a suffix
+			if len(word) < 3 {
+				continue
+			}
+			if lang, ok := languageAliases[word]; ok {
+				return lang
+			}
+		}
+	}
+
+	return ""
+}
+
+// externalTrackTitle builds a readable track title from whatever the sidecar name adds to the video name
+func externalTrackTitle(videoPath string, trackPath string) string {
+	videoStem := strings.TrimSuffix(path.Base(videoPath), path.Ext(videoPath))
+	trackStem := strings.TrimSuffix(path.Base(trackPath), path.Ext(trackPath))
+
+	if strings.HasPrefix(strings.ToLower(trackStem), strings.ToLower(videoStem)) {
+		if extra := strings.Trim(trackStem[len(videoStem):], " ._-[]()"); extra != "" {
+			return extra
+		}
+	}
+
+	// Use the folder name for layouts like "Subs/English/Episode 01.ass"
+	dir := path.Base(path.Dir(trackPath))
+	switch strings.ToLower(dir) {
+	case ".", "/", "sub", "subs", "subtitle", "subtitles", "audio", "audios":
+		return trackStem
+	}
+	return dir
+}
+
+// matchesVideo reports whether a sidecar file belongs to the given video
+func matchesVideo(videoPath string, trackPath string, singleVideo bool) bool {
+	if singleVideo {
+		return true
+	}
+
+	videoStem := strings.ToLower(strings.TrimSuffix(path.Base(videoPath), path.Ext(videoPath)))
+	trackBase := strings.ToLower(path.Base(trackPath))
+
+	// Same name with a language or title suffix, in any folder. The name has to end where the
+	// video's does, so "Ep 1" doesn't claim the subtitles of "Ep 10".
+	if rest, ok := strings.CutPrefix(trackBase, videoStem); ok && (rest == "" || strings.ContainsRune(". _-[(", rune(rest[0]))) {
+		return true
+	}
+
+	// Per episode folders, e.g. "Subs/Episode 01/English.ass"
+	if strings.ToLower(path.Base(path.Dir(trackPath))) == videoStem {
+		return true
+	}
+
+	// Matching season/episode tags, e.g. "Show.S01E03.1080p.mkv" and "Subs/S01E03.eng.srt"
+	videoSeason, videoEpisode, videoOk := ParseEpisodeNumber(videoStem)
+	trackSeason, trackEpisode, trackOk := ParseEpisodeNumber(trackBase)
+	return videoOk && trackOk && videoSeason == trackSeason && videoEpisode == trackEpisode
+}
+
+// LoadExternalSubtitles adds the subtitle files that belong to the playing episode to mpv
+func LoadExternalSubtitles(client *MPVClient, file TorrentFileInfo) error {
+	if len(file.Subtitles) == 0 {
+		return nil
+	}
+
+	config := GetGlobalConfig()
+
+	// Forced subtitles are picked among all tracks once these are loaded
+	if config.ForcedSubtitlesOnly {
+		return addExternalTracks(client, "sub-add", file.Subtitles, -1)
+	}
+
+	// Select the first subtitle in the preferred languages, if any
+	selectIndex := bestTrackIndex(file.Subtitles, preferredLanguages(client, config.PreferredSubtitleLanguages, "slang"))
+
+	// Without a language match, only take over when mpv has nothing selected
+	if selectIndex == -1 {
+		sid, err := client.GetProperty("sid")
+		if err == nil && (sid == nil || sid == false || sid == "no") {
+			selectIndex = 0
+		}
+	}
+
+	return addExternalTracks(client, "sub-add", file.Subtitles, selectIndex)
+}
+
+// LoadExternalAudio adds the dubbed audio files that belong to the playing episode to mpv
+func LoadExternalAudio(client *MPVClient, file TorrentFileInfo) error {
+	if len(file.AudioTracks) == 0 {
+		return nil
+	}
+
+	// Only switch away from the embedded audio when a dub matches the preferred languages
+	selectIndex := bestTrackIndex(file.AudioTracks, preferredLanguages(client, GetGlobalConfig().PreferredAudioLanguages, "alang"))
+
+	return addExternalTracks(client, "audio-add", file.AudioTracks, selectIndex)
+}
+
+// addExternalTracks loads tracks with sub-add/audio-add, selecting the one at selectIndex
+func addExternalTracks(client *MPVClient, command string, tracks []ExternalTrack, selectIndex int) error {
+	for i, track := range tracks {
+		flag := "auto"
+		if i == selectIndex {
+			flag = "select"
+		}
+		_, err := client.Command(command, track.URL, flag, track.Title, track.Language)
+		if err != nil {
+			return fmt.Errorf("failed to add %s: %w", track.Path, err)
+		}
+		Debug("Loaded %s with %s (lang: %s, flag: %s)", track.Path, command, track.Language, flag)
+	}
+
+	return nil
+}
+
+// preferredLanguages uses the configured languages, falling back to mpv's own alang/slang
+func preferredLanguages(client *MPVClient, configured string, property string) []string {
+	if languages := ParseLanguageList(configured); len(languages) > 0 {
+		return languages
+	}
+	return mpvPreferredLanguages(client, property)
+}
+
+// mpvPreferredLanguages reads a language list property (alang/slang) from mpv
+func mpvPreferredLanguages(client *MPVClient, property string) []string {
+	var preferred []string
+	value, err := client.GetProperty(property)
+	if err != nil {
+		return preferred
+	}
+	if languages, ok := value.([]interface{}); ok {
+		for _, lang := range languages {
+			if s, ok := lang.(string); ok {
+				preferred = append(preferred, NormalizeLanguage(s))
+			}
+		}
+	}
+	return preferred
+}
+
+// bestTrackIndex returns the index of the first track in the most preferred language, or -1
+func bestTrackIndex(tracks []ExternalTrack, preferred []string) int {
+	for _, lang := range preferred {
+		for i, track := range tracks {
+			if track.Language != "" && track.Language == lang {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,49 @@
+package internal
+
+import "testing"
+
+func TestMatchesVideo(t *testing.T) {
+	for _, test := range []struct {
+		video, track string
+		want         bool
+	}{
+		{"Show/Ep 1.mkv", "Show/Ep 1.ass", true},
+		{"Show/Ep 1.mkv", "Show/Subs/Ep 1.en.ass", true},
+		{"Show/Ep 1.mkv", "Show/Ep 1 [Signs].ass", true},
+		{"Show/Ep 1.mkv", "Show/Ep 1_eng.srt", true},
+		{"Show/Ep 1.mkv", "Show/Ep 1-forced.srt", true},
+		{"Show/Ep 1.mkv", "Show/Ep 10.ass", false},
+		{"Show/Ep 1.mkv", "Show/Ep 11.en.ass", false},
+		{"Show/Ep 1.mkv", "Show/Subs/Ep 1/English.ass", true},
+		{"Show/Ep 1.mkv", "Show/Subs/Ep 10/English.ass", false},
+		{"Show/Show.S01E03.1080p.mkv", "Show/Subs/S01E03.eng.srt", true},
+		{"Show/Show.S01E03.1080p.mkv", "Show/Subs/S01E04.eng.srt", false},
+	} {
+		if got := matchesVideo(test.video, test.track, false); got != test.want {
+			t.Errorf("matchesVideo(%q, %q) = %v, want %v", test.video, test.track, got, test.want)
+		}
+	}
+
+	if !matchesVideo("Movie.mkv", "Subs/Whatever.srt", true) {
+		t.Error("the only video of a torrent should get every subtitle")
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	for track, want := range map[string]string{
+		"Show/Episode 01.en.ass":         "eng",
+		"Show/Episode 01.eng.forced.ass": "eng",
+		"Show/Episode 01.pt-BR.srt":      "por",
+		"Show/Subs/English/01.ass":       "eng",
+		"Show/Subs/Japanese/01.ass":      "jpn",
+		"Show/Episode 01 [Spanish].srt":  "spa",
+		"Show/Episode 01.ass":            "",
+		"Show/Subs/de/Episode 01.ass":    "",
+		"Show/Audio/Episode 01.ja.mka":   "jpn",
+		"Show/Episode 01 - Tokyo.srt":    "",
+	} {
+		if got := DetectLanguage(track); got != want {
+			t.Errorf("DetectLanguage(%q) = %q, want %q", track, got, want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// GenericPlayer launches a configured command on the stream without any playback tracking.
+// The command may contain {url} and {title} placeholders; without {url} the URL is appended.
+type GenericPlayer struct {
+	Command string
+
+	cmd    *exec.Cmd
+	events chan PlayerEvent
+}
+
+func (p *GenericPlayer) Start(streamURL string, title string) error {
+	fields, err := splitArgs(p.Command)
+	if err != nil {
+		return fmt.Errorf("invalid player command: %w", err)
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("player command is empty")
+	}
+
+	hasURL := false
+	args := make([]string, 0, len(fields))
+	for _, field := range fields[1:] {
+		if strings.Contains(field, "{url}") {
+			hasURL = true
+		}
+		args = append(args, strings.NewReplacer("{url}", streamURL, "{title}", title).Replace(field))
+	}
+	if !hasURL {
+		args = append(args, streamURL)
+	}
+
+	p.cmd = exec.Command(fields[0], args...)
+	p.cmd.Stdout = os.Stdout
+	p.cmd.Stderr = os.Stderr
+	if err := p.cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", fields[0], err)
+	}
+	Debug("Started player command: %s", p.cmd.String())
+
+	p.events = make(chan PlayerEvent)
+	go func() {
+		p.cmd.Wait()
+		close(p.events)
+	}()
+	return nil
+}
+
+func (p *GenericPlayer) unsupported() error {
+	return fmt.Errorf("the generic player does not support playback control")
+}
+
+func (p *GenericPlayer) Seek(seconds int) error       { return p.unsupported() }
+func (p *GenericPlayer) Position() (float64, error)   { return 0, p.unsupported() }
+func (p *GenericPlayer) Duration() (float64, error)   { return 0, p.unsupported() }
+func (p *GenericPlayer) Speed() (float64, error)      { return 0, p.unsupported() }
+func (p *GenericPlayer) SetSpeed(speed float64) error { return p.unsupported() }
+func (p *GenericPlayer) SetPaused(paused bool) error  { return p.unsupported() }
+
+func (p *GenericPlayer) Quit() error {
+	return p.cmd.Process.Kill()
+}
+
+func (p *GenericPlayer) Events() <-chan PlayerEvent {
+	return p.events
+}
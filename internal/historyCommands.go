@@ -0,0 +1,262 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const historyUsage = `Usage: buttercup history <command> [arguments]
+
+Shows are given by their number in "buttercup history list", episodes by their file index.
+
+  list [show]                          List the shows, or the episodes of a show
+  remove <show>                        Remove a show from the history
+  rename <show> [title]                Rename a show, without a title it goes back to the episode title
+  mark-watched <show> [episode...]     Mark episodes watched, or the whole show finished
+  mark-unwatched <show> [episode...]   Mark episodes unwatched, or the whole show not finished
+  reset <show>                         Clear the progress so the show starts over
+  export <file>                        Export the history as JSON, or as CSV for a .csv file ("-" for stdout)
+  import <file>                        Merge an export into the history, keeping whichever copy is newer`
+
+// RunHistoryCommand runs a "buttercup history" subcommand
+func RunHistoryCommand(databaseFile string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing command\n%s", historyUsage)
+	}
+
+	command, args := args[0], args[1:]
+	if command == "list" && len(args) == 0 {
+		listHistory(databaseFile)
+		return nil
+	}
+	switch command {
+	case "help":
+		fmt.Println(historyUsage)
+		return nil
+	case "export":
+		if len(args) != 1 {
+			return fmt.Errorf("export needs a file name\n%s", historyUsage)
+		}
+		return exportHistory(databaseFile, args[0])
+	case "import":
+		if len(args) != 1 {
+			return fmt.Errorf("import needs a file name\n%s", historyUsage)
+		}
+		return importHistory(databaseFile, args[0])
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("missing show number\n%s", historyUsage)
+	}
+
+	torrent, err := historyShow(databaseFile, args[0])
+	if err != nil {
+		return err
+	}
+	args = args[1:]
+
+	switch command {
+	case "list":
+		listEpisodeHistory(databaseFile, torrent)
+		return nil
+	case "remove":
+		if err := LocalRemoveTorrent(databaseFile, torrent.MagnetURI); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s\n", torrent.DisplayTitle())
+	case "rename":
+		title := strings.TrimSpace(strings.Join(args, " "))
+		if err := LocalRenameShow(databaseFile, torrent.MagnetURI, title); err != nil {
+			return err
+		}
+		fmt.Printf("Renamed %s\n", torrent.DisplayTitle())
+	case "mark-watched", "mark-unwatched":
+		fileIndexes := make([]int, len(args))
+		for i, arg := range args {
+			if fileIndexes[i], err = strconv.Atoi(arg); err != nil || fileIndexes[i] < 0 {
+				return fmt.Errorf("invalid episode file index %q", arg)
+			}
+		}
+		watched := command == "mark-watched"
+		if err := LocalMarkEpisodes(databaseFile, torrent.MagnetURI, fileIndexes, watched); err != nil {
+			return err
+		}
+		fmt.Printf("Marked %s\n", markDescription(torrent, len(fileIndexes), watched))
+	case "reset":
+		if err := LocalResetTorrent(databaseFile, torrent.MagnetURI); err != nil {
+			return err
+		}
+		fmt.Printf("Reset %s\n", torrent.DisplayTitle())
+	default:
+		return fmt.Errorf("unknown command %q\n%s", command, historyUsage)
+	}
+	return nil
+}
+
+func exportHistory(databaseFile string, fileName string) error {
+	export := LocalExportHistory(databaseFile)
+	data, err := EncodeHistory(fileName, export)
+	if err != nil {
+		return fmt.Errorf("failed to encode history: %w", err)
+	}
+	if fileName == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := WriteFileAtomic(fileName, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", fileName, err)
+	}
+	fmt.Printf("Exported %d shows to %s\n", len(export.Shows), fileName)
+	return nil
+}
+
+func importHistory(databaseFile string, fileName string) error {
+	input := os.Stdin
+	if fileName != "-" {
+		file, err := os.Open(fileName)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	export, err := DecodeHistory(fileName, input)
+	if err != nil {
+		return err
+	}
+	result, err := LocalImportHistory(databaseFile, export)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d new shows, updated %d shows and %d episodes\n", result.ShowsAdded, result.ShowsUpdated, result.EpisodesUpdated)
+	return nil
+}
+
+// historyShow finds a show by its number in the history list
+func historyShow(databaseFile string, number string) (TorrentData, error) {
+	torrents := LocalGetAllTorrents(databaseFile)
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 || n > len(torrents) {
+		return TorrentData{}, fmt.Errorf("no show %q in the history, see buttercup history list", number)
+	}
+	return torrents[n-1], nil
+}
+
+func listHistory(databaseFile string) {
+	torrents := LocalGetAllTorrents(databaseFile)
+	if len(torrents) == 0 {
+		fmt.Println("No shows in watch history")
+		return
+	}
+	for i, torrent := range torrents {
+		fmt.Printf("%3d. %s\n", i+1, historyLabel(databaseFile, torrent))
+	}
+}
+
+func listEpisodeHistory(databaseFile string, torrent TorrentData) {
+	fmt.Println(historyLabel(databaseFile, torrent))
+
+	episodes := LocalGetShowEpisodes(databaseFile, torrent.MagnetURI)
+	fileIndexes := make([]int, 0, len(episodes))
+	for fileIndex := range episodes {
+		fileIndexes = append(fileIndexes, fileIndex)
+	}
+	sort.Ints(fileIndexes)
+
+	for _, fileIndex := range fileIndexes {
+		episode := episodes[fileIndex]
+		status := fmt.Sprintf("%.0f%%", episode.Percentage())
+		if episode.Watched {
+			status = "watched"
+		}
+		fmt.Printf("  episode %d: %s, last watched %s\n", fileIndex, status, episode.LastWatched.Format("2006-01-02 15:04"))
+	}
+}
+
+// historyLabel names a show with where it is at, e.g. "Show (Ep 7/12 – 43%)"
+func historyLabel(databaseFile string, torrent TorrentData) string {
+	label := fmt.Sprintf("%s (%s)", torrent.DisplayTitle(),
+		ProgressLabel(torrent, LocalGetShowEpisodes(databaseFile, torrent.MagnetURI)))
+	if torrent.Finished {
+		label += " [finished]"
+	}
+	return label
+}
+
+func markDescription(torrent TorrentData, episodes int, watched bool) string {
+	state := "unwatched"
+	if watched {
+		state = "watched"
+	}
+	if episodes == 0 {
+		return fmt.Sprintf("%s as %s", torrent.DisplayTitle(), state)
+	}
+	return fmt.Sprintf("%d episode(s) of %s as %s", episodes, torrent.DisplayTitle(), state)
+}
+
+// ManageHistoryMenu lets the user pick a show from the history and change it
+func ManageHistoryMenu(databaseFile string) error {
+	torrents := LocalGetAllTorrents(databaseFile)
+	if len(torrents) == 0 {
+		return fmt.Errorf("no shows in watch history")
+	}
+
+	options := make(map[string]string)
+	for i, torrent := range torrents {
+		options[strconv.Itoa(i)] = historyLabel(databaseFile, torrent)
+	}
+	selected, err := DynamicSelect(options)
+	if err != nil {
+		return err
+	}
+	if selected.Key == "-1" || selected.Key == "" {
+		return nil
+	}
+	index, _ := strconv.Atoi(selected.Key)
+	torrent := torrents[index]
+
+	actions := map[string]string{
+		"rename":         "Rename",
+		"mark-watched":   "Mark as finished",
+		"mark-unwatched": "Mark as not finished",
+		"reset":          "Reset progress",
+		"remove":         "Remove from history",
+	}
+	action, err := DynamicSelect(actions)
+	if err != nil {
+		return err
+	}
+
+	switch action.Key {
+	case "rename":
+		title, err := promptInput(fmt.Sprintf("New name for %s (empty to use the episode title)", torrent.DisplayTitle()))
+		if err != nil {
+			return err
+		}
+		return LocalRenameShow(databaseFile, torrent.MagnetURI, title)
+	case "mark-watched", "mark-unwatched":
+		return LocalMarkEpisodes(databaseFile, torrent.MagnetURI, nil, action.Key == "mark-watched")
+	case "reset":
+		return LocalResetTorrent(databaseFile, torrent.MagnetURI)
+	case "remove":
+		return LocalRemoveTorrent(databaseFile, torrent.MagnetURI)
+	}
+	return nil
+}
+
+// promptInput asks for a line of text in rofi or the terminal
+func promptInput(message string) (string, error) {
+	if config := GetGlobalConfig(); config != nil && config.RofiSelection {
+		return GetUserInputFromRofi(message)
+	}
+	fmt.Printf("%s: ", message)
+	input, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(input), nil
+}
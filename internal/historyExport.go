@@ -0,0 +1,417 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HistoryExportVersion is the version of the export format written by this buttercup
+const HistoryExportVersion = 1
+
+// HistoryExport is the JSON export of the watch history:
+//
+//	{
+//	  "version": 1,
+//	  "exported_at": "2024-11-02T21:04:05Z",
+//	  "shows": [{
+//	    "magnet_uri": "magnet:?xt=...",
+//	    "show_title": "Frieren",
+//	    "finished": false,
+//	    "anilist_id": 154587,
+//	    "file_index": 7, "file_name": "...", "title": "...", "position": 312,
+//	    "episode_count": 28,
+//	    "updated_at": "2024-11-02T20:58:11Z",
+//	    "chapter_skip": "auto",
+//	    "intro": {"start": 85.1, "end": 175.1},
+//	    "outro": {"start": -95, "end": -5},
+//	    "audio_track": {"language": "jpn", "title": "", "off": false},
+//	    "subtitle_track": {"language": "eng", "title": "Full", "off": false},
+//	    "episodes": [{"file_index": 6, "position": 1440, "duration": 1442, "watched": true, "last_watched": "2024-11-01T22:10:00Z"}]
+//	  }]
+//	}
+//
+// show_title is empty unless the show was renamed, file_index is -1 for a show that was reset.
+// anilist_id is 0 for a show that isn't linked to AniList and -1 for one that isn't on it.
+// Positions and durations are in seconds, timestamps in RFC 3339.
+type HistoryExport struct {
+	Version    int           `json:"version"`
+	ExportedAt time.Time     `json:"exported_at"`
+	Shows      []HistoryShow `json:"shows"`
+}
+
+// HistoryShow is a torrent of the history with the progress of its episodes
+type HistoryShow struct {
+	MagnetURI     string           `json:"magnet_uri"`
+	ShowTitle     string           `json:"show_title"`
+	Finished      bool             `json:"finished"`
+	AnilistID     int              `json:"anilist_id"`
+	FileIndex     int              `json:"file_index"`
+	FileName      string           `json:"file_name"`
+	Title         string           `json:"title"`
+	Position      int              `json:"position"`
+	EpisodeCount  int              `json:"episode_count"`
+	UpdatedAt     time.Time        `json:"updated_at"`
+	ChapterSkip   string           `json:"chapter_skip"`
+	Intro         HistorySegment   `json:"intro"`
+	Outro         HistorySegment   `json:"outro"`
+	AudioTrack    HistoryTrack     `json:"audio_track"`
+	SubtitleTrack HistoryTrack     `json:"subtitle_track"`
+	Episodes      []HistoryEpisode `json:"episodes"`
+}
+
+// HistorySegment is a recorded intro or outro
+type HistorySegment struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// HistoryTrack is the audio or subtitle track picked for a show
+type HistoryTrack struct {
+	Language string `json:"language"`
+	Title    string `json:"title"`
+	Off      bool   `json:"off"`
+}
+
+// HistoryEpisode is the progress of one file of a torrent
+type HistoryEpisode struct {
+	FileIndex   int       `json:"file_index"`
+	Position    int       `json:"position"`
+	Duration    int       `json:"duration"`
+	Watched     bool      `json:"watched"`
+	LastWatched time.Time `json:"last_watched"`
+}
+
+func newHistoryShow(torrent TorrentData, episodes map[int]EpisodeProgress) HistoryShow {
+	show := HistoryShow{
+		MagnetURI:     torrent.MagnetURI,
+		ShowTitle:     torrent.ShowTitle,
+		Finished:      torrent.Finished,
+		AnilistID:     torrent.AnilistID,
+		FileIndex:     torrent.FileIndex,
+		FileName:      torrent.FileName,
+		Title:         torrent.Title,
+		Position:      torrent.PlaybackTime,
+		EpisodeCount:  torrent.EpisodeCount,
+		UpdatedAt:     torrent.UpdatedAt.UTC(),
+		ChapterSkip:   torrent.ChapterSkip,
+		Intro:         HistorySegment(torrent.Intro),
+		Outro:         HistorySegment(torrent.Outro),
+		AudioTrack:    HistoryTrack(torrent.AudioTrack),
+		SubtitleTrack: HistoryTrack(torrent.SubtitleTrack),
+		Episodes:      []HistoryEpisode{},
+	}
+	for _, episode := range episodes {
+		show.Episodes = append(show.Episodes, HistoryEpisode{
+			FileIndex:   episode.FileIndex,
+			Position:    episode.PlaybackTime,
+			Duration:    episode.Duration,
+			Watched:     episode.Watched,
+			LastWatched: episode.LastWatched.UTC(),
+		})
+	}
+	sort.Slice(show.Episodes, func(i, j int) bool {
+		return show.Episodes[i].FileIndex < show.Episodes[j].FileIndex
+	})
+	return show
+}
+
+func (s HistoryShow) torrent() TorrentData {
+	return TorrentData{
+		MagnetURI:     s.MagnetURI,
+		FileName:      s.FileName,
+		FileIndex:     s.FileIndex,
+		PlaybackTime:  s.Position,
+		Title:         s.Title,
+		ShowTitle:     s.ShowTitle,
+		Finished:      s.Finished,
+		AnilistID:     s.AnilistID,
+		ChapterSkip:   s.ChapterSkip,
+		Intro:         SkipSegment(s.Intro),
+		Outro:         SkipSegment(s.Outro),
+		EpisodeCount:  s.EpisodeCount,
+		AudioTrack:    TrackChoice(s.AudioTrack),
+		SubtitleTrack: TrackChoice(s.SubtitleTrack),
+		UpdatedAt:     s.UpdatedAt,
+	}
+}
+
+func (e HistoryEpisode) progress(magnetURI string) EpisodeProgress {
+	return EpisodeProgress{
+		MagnetURI:    magnetURI,
+		FileIndex:    e.FileIndex,
+		PlaybackTime: e.Position,
+		Duration:     e.Duration,
+		Watched:      e.Watched,
+		LastWatched:  e.LastWatched,
+	}
+}
+
+// LocalExportHistory collects the whole watch history for export
+func LocalExportHistory(databaseFile string) HistoryExport {
+	export := HistoryExport{Version: HistoryExportVersion, ExportedAt: time.Now().UTC(), Shows: []HistoryShow{}}
+	for _, torrent := range LocalGetAllTorrents(databaseFile) {
+		export.Shows = append(export.Shows, newHistoryShow(torrent, LocalGetShowEpisodes(databaseFile, torrent.MagnetURI)))
+	}
+	return export
+}
+
+// HistoryImportResult counts what an import changed
+type HistoryImportResult struct {
+	ShowsAdded      int
+	ShowsUpdated    int
+	EpisodesUpdated int
+}
+
+// LocalImportHistory merges an export into the watch history. Shows and episodes that are already
+// in the history are only replaced when the imported copy is newer.
+func LocalImportHistory(databaseFile string, export HistoryExport) (HistoryImportResult, error) {
+	var result HistoryImportResult
+	if export.Version > HistoryExportVersion {
+		return result, fmt.Errorf("the export is from a newer buttercup (version %d), please update", export.Version)
+	}
+
+	db, err := openWatchDatabase(databaseFile)
+	if err != nil {
+		return result, err
+	}
+
+	unlock, err := LockFile(databaseFile)
+	if err != nil {
+		return result, err
+	}
+	defer unlock()
+
+	torrents := LocalGetAllTorrents(databaseFile)
+	episodes := make(map[string]map[int]EpisodeProgress)
+	for _, show := range export.Shows {
+		episodes[show.MagnetURI] = LocalGetShowEpisodes(databaseFile, show.MagnetURI)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	for _, show := range export.Shows {
+		if show.MagnetURI == "" {
+			continue
+		}
+		existing := LocalFindTorrentByURI(torrents, show.MagnetURI)
+		if existing == nil || show.UpdatedAt.After(existing.UpdatedAt) {
+			if err := saveTorrent(tx, show.torrent()); err != nil {
+				return result, fmt.Errorf("failed to import %s: %w", show.MagnetURI, err)
+			}
+			if existing == nil {
+				result.ShowsAdded++
+			} else {
+				result.ShowsUpdated++
+			}
+		}
+
+		for _, episode := range show.Episodes {
+			current, ok := episodes[show.MagnetURI][episode.FileIndex]
+			if ok && !episode.LastWatched.After(current.LastWatched) {
+				continue
+			}
+			if err := saveEpisode(tx, episode.progress(show.MagnetURI)); err != nil {
+				return result, fmt.Errorf("failed to import episode %d of %s: %w", episode.FileIndex, show.MagnetURI, err)
+			}
+			result.EpisodesUpdated++
+		}
+	}
+	return result, tx.Commit()
+}
+
+// WriteHistoryJSON encodes an export as indented JSON
+func WriteHistoryJSON(w io.Writer, export HistoryExport) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(export)
+}
+
+// ReadHistoryJSON decodes a JSON export
+func ReadHistoryJSON(r io.Reader) (HistoryExport, error) {
+	var export HistoryExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return export, fmt.Errorf("invalid history export: %w", err)
+	}
+	return export, nil
+}
+
+// historyCSVHeader are the columns of the flat CSV export, one row per episode with the show repeated.
+// Shows without episode progress get a single row with the episode columns left empty.
+var historyCSVHeader = []string{
+	"magnet_uri", "show_title", "finished", "anilist_id", "file_index", "file_name", "title", "position", "episode_count", "updated_at",
+	"chapter_skip", "intro_start", "intro_end", "outro_start", "outro_end",
+	"audio_language", "audio_title", "audio_off", "subtitle_language", "subtitle_title", "subtitles_off",
+	"episode_file_index", "episode_position", "episode_duration", "episode_watched", "episode_last_watched",
+}
+
+// WriteHistoryCSV writes an export as flat CSV
+func WriteHistoryCSV(w io.Writer, export HistoryExport) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(historyCSVHeader); err != nil {
+		return err
+	}
+
+	for _, show := range export.Shows {
+		row := []string{
+			show.MagnetURI, show.ShowTitle, strconv.FormatBool(show.Finished), strconv.Itoa(show.AnilistID), strconv.Itoa(show.FileIndex),
+			show.FileName, show.Title, strconv.Itoa(show.Position), strconv.Itoa(show.EpisodeCount),
+			show.UpdatedAt.Format(time.RFC3339), show.ChapterSkip,
+			formatCSVFloat(show.Intro.Start), formatCSVFloat(show.Intro.End),
+			formatCSVFloat(show.Outro.Start), formatCSVFloat(show.Outro.End),
+			show.AudioTrack.Language, show.AudioTrack.Title, strconv.FormatBool(show.AudioTrack.Off),
+			show.SubtitleTrack.Language, show.SubtitleTrack.Title, strconv.FormatBool(show.SubtitleTrack.Off),
+		}
+		if len(show.Episodes) == 0 {
+			if err := writer.Write(append(row, "", "", "", "", "")); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, episode := range show.Episodes {
+			episodeRow := append(append([]string{}, row...),
+				strconv.Itoa(episode.FileIndex), strconv.Itoa(episode.Position), strconv.Itoa(episode.Duration),
+				strconv.FormatBool(episode.Watched), episode.LastWatched.Format(time.RFC3339))
+			if err := writer.Write(episodeRow); err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func formatCSVFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// ReadHistoryCSV reads a CSV export, the columns are found by the header so they can be in any order
+func ReadHistoryCSV(r io.Reader) (HistoryExport, error) {
+	export := HistoryExport{Version: HistoryExportVersion}
+
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return export, fmt.Errorf("invalid history export: %w", err)
+	}
+	if len(records) == 0 {
+		return export, fmt.Errorf("invalid history export: missing header")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	if _, ok := columns["magnet_uri"]; !ok {
+		return export, fmt.Errorf("invalid history export: missing magnet_uri column")
+	}
+
+	shows := make(map[string]int)
+	for line, record := range records[1:] {
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		var parseErr error
+		parseInt := func(name string) int {
+			value := field(name)
+			if value == "" {
+				return 0
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil && parseErr == nil {
+				parseErr = fmt.Errorf("line %d: invalid %s %q", line+2, name, value)
+			}
+			return n
+		}
+		parseFloat := func(name string) float64 {
+			n, _ := strconv.ParseFloat(field(name), 64)
+			return n
+		}
+		parseBool := func(name string) bool {
+			b, _ := strconv.ParseBool(field(name))
+			return b
+		}
+		parseTime := func(name string) time.Time {
+			value := field(name)
+			if value == "" {
+				return time.Time{}
+			}
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil && parseErr == nil {
+				parseErr = fmt.Errorf("line %d: invalid %s %q", line+2, name, value)
+			}
+			return t
+		}
+
+		magnetURI := field("magnet_uri")
+		i, ok := shows[magnetURI]
+		if !ok {
+			i = len(export.Shows)
+			shows[magnetURI] = i
+			export.Shows = append(export.Shows, HistoryShow{
+				MagnetURI:     magnetURI,
+				ShowTitle:     field("show_title"),
+				Finished:      parseBool("finished"),
+				AnilistID:     parseInt("anilist_id"),
+				FileIndex:     parseInt("file_index"),
+				FileName:      field("file_name"),
+				Title:         field("title"),
+				Position:      parseInt("position"),
+				EpisodeCount:  parseInt("episode_count"),
+				UpdatedAt:     parseTime("updated_at"),
+				ChapterSkip:   field("chapter_skip"),
+				Intro:         HistorySegment{Start: parseFloat("intro_start"), End: parseFloat("intro_end")},
+				Outro:         HistorySegment{Start: parseFloat("outro_start"), End: parseFloat("outro_end")},
+				AudioTrack:    HistoryTrack{Language: field("audio_language"), Title: field("audio_title"), Off: parseBool("audio_off")},
+				SubtitleTrack: HistoryTrack{Language: field("subtitle_language"), Title: field("subtitle_title"), Off: parseBool("subtitles_off")},
+			})
+		}
+
+		if field("episode_file_index") != "" {
+			export.Shows[i].Episodes = append(export.Shows[i].Episodes, HistoryEpisode{
+				FileIndex:   parseInt("episode_file_index"),
+				Position:    parseInt("episode_position"),
+				Duration:    parseInt("episode_duration"),
+				Watched:     parseBool("episode_watched"),
+				LastWatched: parseTime("episode_last_watched"),
+			})
+		}
+		if parseErr != nil {
+			return export, fmt.Errorf("invalid history export: %w", parseErr)
+		}
+	}
+	return export, nil
+}
+
+// EncodeHistory writes an export in the format matching the file name, CSV for .csv and JSON otherwise
+func EncodeHistory(fileName string, export HistoryExport) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if strings.EqualFold(filepath.Ext(fileName), ".csv") {
+		err = WriteHistoryCSV(&buf, export)
+	} else {
+		err = WriteHistoryJSON(&buf, export)
+	}
+	return buf.Bytes(), err
+}
+
+// DecodeHistory reads an export in the format matching the file name, CSV for .csv and JSON otherwise
+func DecodeHistory(fileName string, r io.Reader) (HistoryExport, error) {
+	if strings.EqualFold(filepath.Ext(fileName), ".csv") {
+		return ReadHistoryCSV(r)
+	}
+	return ReadHistoryJSON(r)
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestHistory creates a watch database with a show that has every setting and two episodes,
+// and one that was only opened
+func newTestHistory(t *testing.T) string {
+	t.Helper()
+	SetGlobalConfig(&ProgramConfig{StoragePath: t.TempDir()})
+	databaseFile := filepath.Join(t.TempDir(), "buttercup.db")
+
+	if err := LocalUpdateTorrent(databaseFile, "magnet:?xt=urn:btih:aaa", 4, 610, "Show.S01E05.mkv (1.2 GB)"); err != nil {
+		t.Fatal(err)
+	}
+	err := LocalUpdateTorrentSettings(databaseFile, "magnet:?xt=urn:btih:aaa", func(torrent *TorrentData) {
+		torrent.ShowTitle = "Show"
+		torrent.AnilistID = 1234
+		torrent.EpisodeCount = 12
+		torrent.ChapterSkip = "auto"
+		torrent.Intro = SkipSegment{Start: 62.5, End: 152.5}
+		torrent.Outro = SkipSegment{Start: 1300, End: 1390.25}
+		torrent.AudioTrack = TrackChoice{Language: "jpn", Title: "Japanese"}
+		torrent.SubtitleTrack = TrackChoice{Off: true}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := LocalUpdateEpisode(databaseFile, "magnet:?xt=urn:btih:aaa", 3, 1400, 1420, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := LocalUpdateEpisode(databaseFile, "magnet:?xt=urn:btih:aaa", 4, 610, 1420, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := LocalUpdateTorrent(databaseFile, "magnet:?xt=urn:btih:bbb", NotStartedFileIndex, 0, "Movie.2020.mkv (4 GB)"); err != nil {
+		t.Fatal(err)
+	}
+	return databaseFile
+}
+
+func TestHistoryExportRoundTrip(t *testing.T) {
+	for _, fileName := range []string{"history.json", "history.csv"} {
+		t.Run(fileName, func(t *testing.T) {
+			export := LocalExportHistory(newTestHistory(t))
+			if len(export.Shows) != 2 || len(export.Shows[0].Episodes) != 2 {
+				t.Fatalf("unexpected export: %+v", export)
+			}
+
+			data, err := EncodeHistory(fileName, export)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := DecodeHistory(fileName, bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			databaseFile := filepath.Join(t.TempDir(), "imported.db")
+			result, err := LocalImportHistory(databaseFile, decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != (HistoryImportResult{ShowsAdded: 2, EpisodesUpdated: 2}) {
+				t.Errorf("got %+v", result)
+			}
+			imported := LocalExportHistory(databaseFile)
+			if !reflect.DeepEqual(imported.Shows, export.Shows) {
+				t.Errorf("imported history differs\n got: %+v\nwant: %+v", imported.Shows, export.Shows)
+			}
+		})
+	}
+}
+
+func TestHistoryExportTrackOff(t *testing.T) {
+	for _, fileName := range []string{"history.json", "history.csv"} {
+		export := HistoryExport{Version: HistoryExportVersion, Shows: []HistoryShow{{
+			MagnetURI:     "magnet:?xt=urn:btih:aaa",
+			UpdatedAt:     time.Date(2024, 5, 1, 20, 0, 0, 0, time.UTC),
+			AudioTrack:    HistoryTrack{Off: true},
+			SubtitleTrack: HistoryTrack{Off: true},
+			Episodes:      []HistoryEpisode{{FileIndex: 0, LastWatched: time.Date(2024, 5, 1, 20, 0, 0, 0, time.UTC)}},
+		}}}
+		data, err := EncodeHistory(fileName, export)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := DecodeHistory(fileName, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if show := decoded.Shows[0]; !show.AudioTrack.Off || !show.SubtitleTrack.Off {
+			t.Errorf("%s: tracks turned off were lost: %+v", fileName, show)
+		}
+	}
+}
+
+func TestHistoryImportKeepsNewer(t *testing.T) {
+	databaseFile := newTestHistory(t)
+	export := LocalExportHistory(databaseFile)
+
+	older := LocalExportHistory(databaseFile)
+	show := &older.Shows[0]
+	show.ShowTitle = "Older"
+	show.UpdatedAt = show.UpdatedAt.Add(-time.Hour)
+	show.Episodes[1].Position = 10
+	show.Episodes[1].LastWatched = show.Episodes[1].LastWatched.Add(-time.Hour)
+	result, err := LocalImportHistory(databaseFile, older)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (HistoryImportResult{}) {
+		t.Errorf("an older export changed the history: %+v", result)
+	}
+	if current := LocalExportHistory(databaseFile); !reflect.DeepEqual(current.Shows, export.Shows) {
+		t.Errorf("history changed\n got: %+v\nwant: %+v", current.Shows, export.Shows)
+	}
+
+	newer := LocalExportHistory(databaseFile)
+	show = &newer.Shows[0]
+	show.ShowTitle = "Newer"
+	show.UpdatedAt = show.UpdatedAt.Add(time.Hour)
+	show.Episodes[1].Position = 900
+	show.Episodes[1].LastWatched = show.Episodes[1].LastWatched.Add(time.Hour)
+	result, err = LocalImportHistory(databaseFile, newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (HistoryImportResult{ShowsUpdated: 1, EpisodesUpdated: 1}) {
+		t.Errorf("got %+v", result)
+	}
+	current := LocalGetTorrent(databaseFile, show.MagnetURI)
+	if current == nil || current.ShowTitle != "Newer" {
+		t.Errorf("the newer show was not imported: %+v", current)
+	}
+	if episode := LocalGetShowEpisodes(databaseFile, show.MagnetURI)[4]; episode.PlaybackTime != 900 {
+		t.Errorf("the newer episode was not imported: %+v", episode)
+	}
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// NotStartedFileIndex is the file index of a show that was reset, it starts over at its first episode
+const NotStartedFileIndex = -1
+
+// changeWatchHistory runs change in one transaction while holding the history lock
+func changeWatchHistory(databaseFile string, magnetURI string, change func(tx *sql.Tx, torrent TorrentData, episodes map[int]EpisodeProgress) error) error {
+	db, err := openWatchDatabase(databaseFile)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := LockFile(databaseFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	torrent := LocalGetTorrent(databaseFile, magnetURI)
+	if torrent == nil {
+		return fmt.Errorf("torrent is not in the history")
+	}
+	episodes := LocalGetShowEpisodes(databaseFile, magnetURI)
+
+	torrent.UpdatedAt = time.Now()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := change(tx, *torrent, episodes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LocalRemoveTorrent forgets a torrent and the progress of its episodes, along with its show when nothing else uses it
+func LocalRemoveTorrent(databaseFile string, magnetURI string) error {
+	return changeWatchHistory(databaseFile, magnetURI, func(tx *sql.Tx, torrent TorrentData, episodes map[int]EpisodeProgress) error {
+		if _, err := tx.Exec("DELETE FROM torrents WHERE magnet_uri = ?", magnetURI); err != nil {
+			return fmt.Errorf("error removing torrent: %w", err)
+		}
+		if _, err := tx.Exec("DELETE FROM watch_events WHERE magnet_uri = ?", magnetURI); err != nil {
+			return fmt.Errorf("error removing watch events: %w", err)
+		}
+		_, err := tx.Exec("DELETE FROM shows WHERE id NOT IN (SELECT show_id FROM torrents)")
+		return err
+	})
+}
+
+// LocalResetTorrent clears the progress of a torrent so it starts over at the first episode.
+// The show's settings and the log of watch events are kept.
+func LocalResetTorrent(databaseFile string, magnetURI string) error {
+	return changeWatchHistory(databaseFile, magnetURI, func(tx *sql.Tx, torrent TorrentData, episodes map[int]EpisodeProgress) error {
+		if _, err := tx.Exec("DELETE FROM files WHERE magnet_uri = ?", magnetURI); err != nil {
+			return fmt.Errorf("error clearing episode progress: %w", err)
+		}
+		torrent.FileIndex = NotStartedFileIndex
+		torrent.PlaybackTime = 0
+		torrent.Finished = false
+		return saveTorrent(tx, torrent)
+	})
+}
+
+// LocalMarkEpisodes marks episodes of a torrent as watched or unwatched, unwatched ones lose their progress.
+// Without file indexes the whole show is marked: watched shows are finished and hidden from Continue Watching.
+func LocalMarkEpisodes(databaseFile string, magnetURI string, fileIndexes []int, watched bool) error {
+	return changeWatchHistory(databaseFile, magnetURI, func(tx *sql.Tx, torrent TorrentData, episodes map[int]EpisodeProgress) error {
+		if len(fileIndexes) == 0 {
+			torrent.Finished = watched
+			if err := saveTorrent(tx, torrent); err != nil {
+				return fmt.Errorf("error saving torrent: %w", err)
+			}
+			for fileIndex := range episodes {
+				fileIndexes = append(fileIndexes, fileIndex)
+			}
+			if watched && torrent.FileIndex != NotStartedFileIndex {
+				fileIndexes = append(fileIndexes, torrent.FileIndex)
+			}
+		}
+
+		for _, fileIndex := range fileIndexes {
+			episode, ok := episodes[fileIndex]
+			if !ok {
+				episode = EpisodeProgress{MagnetURI: magnetURI, FileIndex: fileIndex}
+			}
+			episode.Watched = watched
+			if !watched {
+				episode.PlaybackTime = 0
+			}
+			episode.LastWatched = time.Now()
+			if err := saveEpisode(tx, episode); err != nil {
+				return fmt.Errorf("error saving episode: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// LocalRenameShow changes the name a show is listed under, an empty title goes back to the episode title
+func LocalRenameShow(databaseFile string, magnetURI string, title string) error {
+	return changeWatchHistory(databaseFile, magnetURI, func(tx *sql.Tx, torrent TorrentData, episodes map[int]EpisodeProgress) error {
+		torrent.ShowTitle = title
+		return saveTorrent(tx, torrent)
+	})
+}
@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var currentHlsTranscoder *HlsTranscoder
+
+// HlsQualities maps the selectable qualities to output height and video bitrate
+var HlsQualities = map[string]struct {
+	Height  int
+	Bitrate string
+}{
+	"1080p": {1080, "5000k"},
+	"720p":  {720, "2800k"},
+	"480p":  {480, "1400k"},
+	"360p":  {360, "800k"},
+}
+
+// HlsOptions selects the output quality and which input tracks end up in the stream
+type HlsOptions struct {
+	Quality       string
+	AudioTrack    int
+	SubtitleTrack int // -1 disables burn-in
+}
+
+// HlsTranscoder pipes a stream through ffmpeg and serves the resulting HLS playlist
+type HlsTranscoder struct {
+	PlaylistURL string
+	PageURL     string
+
+	dir    string
+	cmd    *exec.Cmd
+	server *http.Server
+	exited chan error
+}
+
+// escapeFilterValue escapes a value for an ffmpeg filter option inside a filtergraph
+func escapeFilterValue(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(value)
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(value)
+}
+
+// hlsJsCDN is where the browser page loads hls.js from unless a local copy is configured
+const hlsJsCDN = "https://cdn.jsdelivr.net/npm/hls.js@1"
+
+// hlsArgs builds the ffmpeg command line for an input and output directory
+func hlsArgs(input string, dir string, opts HlsOptions) ([]string, error) {
+	args := []string{
+		"-hide_banner", "-loglevel", "error",
+		"-i", input,
+		"-map", "0:v:0",
+		"-map", fmt.Sprintf("0:a:%d?", opts.AudioTrack),
+		// Browsers and phones only reliably decode 8-bit H.264
+		"-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-ac", "2", "-b:a", "128k",
+	}
+
+	var filters []string
+	if opts.Quality != "" && opts.Quality != "source" {
+		quality, ok := HlsQualities[opts.Quality]
+		if !ok {
+			return nil, fmt.Errorf("unknown HLS quality %q", opts.Quality)
+		}
+		filters = append(filters, fmt.Sprintf("scale=-2:%d", quality.Height))
+		args = append(args, "-b:v", quality.Bitrate, "-maxrate", quality.Bitrate, "-bufsize", quality.Bitrate)
+	} else {
+		args = append(args, "-crf", "20")
+	}
+	if opts.SubtitleTrack >= 0 {
+		filters = append(filters, fmt.Sprintf("subtitles=filename=%s:si=%d", escapeFilterValue(input), opts.SubtitleTrack))
+	}
+	if len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+	}
+
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", "6",
+		"-hls_list_size", "0",
+		"-hls_playlist_type", "event",
+		"-hls_segment_filename", filepath.Join(dir, "segment%05d.ts"),
+		filepath.Join(dir, "index.m3u8"),
+	)
+	return args, nil
+}
+
+// StartHlsTranscode starts ffmpeg on the input and serves the HLS output once the first segment exists
+func StartHlsTranscode(input string, opts HlsOptions) (*HlsTranscoder, error) {
+	config := GetGlobalConfig()
+
+	dir, err := os.MkdirTemp("", "buttercup-hls-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HLS directory: %w", err)
+	}
+
+	args, err := hlsArgs(input, dir, opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	transcoder := &HlsTranscoder{
+		dir:    dir,
+		cmd:    exec.Command(config.FfmpegPath, args...),
+		exited: make(chan error, 1),
+	}
+	transcoder.cmd.Stderr = os.Stderr
+	Debug("ffmpeg command: %s", transcoder.cmd.String())
+
+	if err := transcoder.cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	go func() {
+		transcoder.exited <- transcoder.cmd.Wait()
+	}()
+
+	// Browsers without native HLS need hls.js, served from HlsJsPath for networks without internet access
+	hlsJs := hlsJsCDN
+	mux := http.NewServeMux()
+	if config.HlsJsPath != "" {
+		hlsJsPath := os.ExpandEnv(config.HlsJsPath)
+		hlsJs = "hls.min.js"
+		mux.HandleFunc("/hls.min.js", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/javascript")
+			http.ServeFile(w, r, hlsJsPath)
+		})
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, hlsPlayerPage, hlsJs)
+	})
+	mux.Handle("/hls/", http.StripPrefix("/hls/", noCache(http.FileServer(http.Dir(dir)))))
+
+	listener, err := net.Listen("tcp", ":"+config.HlsPort)
+	if err != nil {
+		transcoder.cmd.Process.Kill()
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to listen on port %s: %w", config.HlsPort, err)
+	}
+	transcoder.server = &http.Server{Handler: mux}
+	go transcoder.server.Serve(listener)
+
+	host, err := lanIP()
+	if err != nil {
+		host = "127.0.0.1"
+	}
+	transcoder.PageURL = fmt.Sprintf("http://%s:%s/", host, config.HlsPort)
+	transcoder.PlaylistURL = transcoder.PageURL + "hls/index.m3u8"
+	currentHlsTranscoder = transcoder
+
+	// Wait until the playlist has its first segment so players don't give up on an empty list
+	playlist := filepath.Join(dir, "index.m3u8")
+	for {
+		select {
+		case err := <-transcoder.exited:
+			transcoder.exited <- err
+			StopHlsTranscode()
+			return nil, fmt.Errorf("ffmpeg exited before producing a segment: %v", err)
+		case <-time.After(500 * time.Millisecond):
+		}
+		if data, err := os.ReadFile(playlist); err == nil && strings.Contains(string(data), "#EXTINF") {
+			return transcoder, nil
+		}
+	}
+}
+
+// Wait blocks until ffmpeg finishes transcoding
+func (t *HlsTranscoder) Wait() error {
+	err := <-t.exited
+	t.exited <- err
+	return err
+}
+
+// StopHlsTranscode stops ffmpeg and the HLS server and removes the segments
+func StopHlsTranscode() {
+	if currentHlsTranscoder == nil {
+		return
+	}
+	transcoder := currentHlsTranscoder
+	currentHlsTranscoder = nil
+
+	if transcoder.cmd.Process != nil {
+		transcoder.cmd.Process.Kill()
+	}
+	transcoder.server.Close()
+	os.RemoveAll(transcoder.dir)
+}
+
+// noCache stops clients from caching the playlist while segments are still being added
+func noCache(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		next.ServeHTTP(w, r)
+	})
+}
+
+const hlsPlayerPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>buttercup</title>
+<style>body{margin:0;background:#000}video{width:100vw;height:100vh}</style>
+<script src="%s"></script>
+</head>
+<body>
+<video id="video" controls autoplay playsinline></video>
+<script>
+var video = document.getElementById("video");
+if (video.canPlayType("application/vnd.apple.mpegurl")) {
+	video.src = "hls/index.m3u8";
+} else if (window.Hls && Hls.isSupported()) {
+	var hls = new Hls();
+	hls.loadSource("hls/index.m3u8");
+	hls.attachMedia(video);
+}
+</script>
+</body>
+</html>
+`
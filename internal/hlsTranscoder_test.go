@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"io"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHlsTranscode(t *testing.T) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+
+	source := filepath.Join(t.TempDir(), "source.mkv")
+	generate := exec.Command(ffmpeg, "-hide_banner", "-loglevel", "error",
+		"-f", "lavfi", "-i", "testsrc=duration=8:size=640x360:rate=25",
+		"-f", "lavfi", "-i", "sine=duration=8",
+		"-shortest", source)
+	if output, err := generate.CombinedOutput(); err != nil {
+		t.Fatalf("failed to generate test video: %v\n%s", err, output)
+	}
+
+	port, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetGlobalConfig(&ProgramConfig{FfmpegPath: ffmpeg, HlsPort: strconv.Itoa(port)})
+	transcoder, err := StartHlsTranscode(source, HlsOptions{Quality: "360p", SubtitleTrack: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer StopHlsTranscode()
+	if err := transcoder.Wait(); err != nil {
+		t.Fatalf("ffmpeg failed: %v", err)
+	}
+
+	playlist := httpGet(t, transcoder.PlaylistURL)
+	if !strings.Contains(playlist, "#EXT-X-ENDLIST") {
+		t.Errorf("playlist is not finished:\n%s", playlist)
+	}
+	var segments []string
+	for _, line := range strings.Split(playlist, "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			segments = append(segments, line)
+		}
+	}
+	if len(segments) < 2 {
+		t.Fatalf("expected at least 2 segments of 6s for 8s of video, got %d:\n%s", len(segments), playlist)
+	}
+	for _, segment := range segments {
+		data := httpGet(t, transcoder.PageURL+"hls/"+segment)
+		// MPEG-TS packets start with the 0x47 sync byte
+		if len(data) == 0 || data[0] != 0x47 {
+			t.Errorf("segment %s is not MPEG-TS", segment)
+		}
+	}
+
+	if page := httpGet(t, transcoder.PageURL); !strings.Contains(page, "hls/index.m3u8") || !strings.Contains(page, hlsJsCDN) {
+		t.Errorf("unexpected player page:\n%s", page)
+	}
+}
+
+func httpGet(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,11 @@
+package internal
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	InitLogger(false)
+	os.Exit(m.Run())
+}
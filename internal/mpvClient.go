@@ -0,0 +1,269 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PlayerEvent is an event from a player, in mpv's IPC vocabulary (property names like "time-pos")
+type PlayerEvent struct {
+	Name     string      // e.g. "property-change", "end-file", "client-message"
+	Property string      // Set for "property-change"
+	Data     interface{} // New property value for "property-change"
+	Args     []string    // Arguments of a "client-message"
+	Reason   string      // Reason of an "end-file"
+}
+
+// Float returns the event data as a number, if it is one
+func (e PlayerEvent) Float() (float64, bool) {
+	value, ok := e.Data.(float64)
+	return value, ok
+}
+
+// Bool returns the event data as a flag, if it is one
+func (e PlayerEvent) Bool() (bool, bool) {
+	value, ok := e.Data.(bool)
+	return value, ok
+}
+
+type mpvResponse struct {
+	Data  interface{}
+	Error string
+}
+
+// MPVClient is a long-lived connection to mpv that matches replies to commands by request_id
+// and delivers everything else as events
+type MPVClient struct {
+	conn      net.Conn
+	writeMu   sync.Mutex
+	nextID    int64
+	observeID int64
+
+	pendingMu sync.Mutex
+	pending   map[int64]chan mpvResponse
+	closed    bool
+
+	events    chan PlayerEvent
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ConnectMPV connects to mpv's IPC socket, waiting up to timeout for mpv to create it
+func ConnectMPV(socketPath string, timeout time.Duration) (*MPVClient, error) {
+	deadline := time.Now().Add(timeout)
+	var conn net.Conn
+	var err error
+	for {
+		conn, err = net.Dial("unix", socketPath)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("failed to connect to mpv: %w", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	client := &MPVClient{
+		conn:    conn,
+		pending: make(map[int64]chan mpvResponse),
+		events:  make(chan PlayerEvent),
+		done:    make(chan struct{}),
+	}
+
+	incoming := make(chan PlayerEvent)
+	go client.readLoop(incoming)
+	go client.dispatchEvents(incoming)
+	return client, nil
+}
+
+// Events returns the channel of mpv events, closed when mpv goes away
+func (c *MPVClient) Events() <-chan PlayerEvent {
+	return c.events
+}
+
+// Command sends a command and waits for mpv's reply
+func (c *MPVClient) Command(args ...interface{}) (interface{}, error) {
+	id := atomic.AddInt64(&c.nextID, 1)
+	reply := make(chan mpvResponse, 1)
+
+	c.pendingMu.Lock()
+	if c.closed {
+		c.pendingMu.Unlock()
+		return nil, fmt.Errorf("mpv connection closed")
+	}
+	c.pending[id] = reply
+	c.pendingMu.Unlock()
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"command":    args,
+		"request_id": id,
+	})
+	if err != nil {
+		c.forget(id)
+		return nil, err
+	}
+
+	c.writeMu.Lock()
+	_, err = c.conn.Write(append(payload, '\n'))
+	c.writeMu.Unlock()
+	if err != nil {
+		c.forget(id)
+		return nil, err
+	}
+
+	response, ok := <-reply
+	if !ok {
+		return nil, fmt.Errorf("mpv connection closed")
+	}
+	if response.Error != "success" {
+		return nil, fmt.Errorf("mpv error: %s", response.Error)
+	}
+	return response.Data, nil
+}
+
+// GetProperty reads a property from mpv
+func (c *MPVClient) GetProperty(name string) (interface{}, error) {
+	return c.Command("get_property", name)
+}
+
+// SetProperty changes a property in mpv
+func (c *MPVClient) SetProperty(name string, value interface{}) error {
+	_, err := c.Command("set_property", name, value)
+	return err
+}
+
+// ObserveProperty subscribes to changes of a property, delivered as "property-change" events
+func (c *MPVClient) ObserveProperty(name string) error {
+	_, err := c.Command("observe_property", atomic.AddInt64(&c.observeID, 1), name)
+	return err
+}
+
+// ShowText shows a message on mpv's OSD for the given duration
+func (c *MPVClient) ShowText(text string, duration time.Duration) error {
+	_, err := c.Command("show-text", text, duration.Milliseconds())
+	return err
+}
+
+// BindKey makes a key in mpv send a "buttercup" script-message with the given arguments,
+// delivered to us as a "client-message" event
+func (c *MPVClient) BindKey(key string, args ...string) error {
+	command := "script-message buttercup"
+	for _, arg := range args {
+		command += " " + strconv.Quote(arg)
+	}
+	_, err := c.Command("keybind", key, command)
+	return err
+}
+
+// Close disconnects from mpv without stopping it
+func (c *MPVClient) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return c.conn.Close()
+}
+
+func (c *MPVClient) forget(id int64) {
+	c.pendingMu.Lock()
+	delete(c.pending, id)
+	c.pendingMu.Unlock()
+}
+
+// readLoop splits mpv's output into replies and events until the connection drops
+func (c *MPVClient) readLoop(incoming chan<- PlayerEvent) {
+	defer close(incoming)
+
+	scanner := bufio.NewScanner(c.conn)
+	// Properties like track-list and chapter-list can get long
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var message struct {
+			RequestID *int64      `json:"request_id"`
+			Error     string      `json:"error"`
+			Data      interface{} `json:"data"`
+			Event     string      `json:"event"`
+			Name      string      `json:"name"`
+			Args      []string    `json:"args"`
+			Reason    string      `json:"reason"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			Debug("Ignoring malformed mpv message: %s", scanner.Text())
+			continue
+		}
+
+		if message.Event != "" {
+			incoming <- PlayerEvent{
+				Name:     message.Event,
+				Property: message.Name,
+				Data:     message.Data,
+				Args:     message.Args,
+				Reason:   message.Reason,
+			}
+			continue
+		}
+
+		if message.RequestID != nil {
+			c.pendingMu.Lock()
+			reply, ok := c.pending[*message.RequestID]
+			delete(c.pending, *message.RequestID)
+			c.pendingMu.Unlock()
+			if ok {
+				reply <- mpvResponse{Data: message.Data, Error: message.Error}
+			}
+		}
+	}
+
+	// Fail everything still waiting for a reply
+	c.pendingMu.Lock()
+	c.closed = true
+	for id, reply := range c.pending {
+		close(reply)
+		delete(c.pending, id)
+	}
+	c.pendingMu.Unlock()
+}
+
+// dispatchEvents queues events so a slow consumer never blocks replies to its own commands
+func (c *MPVClient) dispatchEvents(incoming <-chan PlayerEvent) {
+	defer close(c.events)
+
+	var queue []PlayerEvent
+	for {
+		var out chan PlayerEvent
+		var next PlayerEvent
+		if len(queue) > 0 {
+			out = c.events
+			next = queue[0]
+		}
+
+		select {
+		case event, ok := <-incoming:
+			if !ok {
+				// Deliver what is left unless the consumer has hung up
+				for _, event := range queue {
+					select {
+					case c.events <- event:
+					case <-c.done:
+						return
+					}
+				}
+				return
+			}
+			queue = append(queue, event)
+		case out <- next:
+			queue = queue[1:]
+		case <-c.done:
+			// Keep reading so readLoop can finish
+			for range incoming {
+			}
+			return
+		}
+	}
+}
@@ -1,183 +1,277 @@
 package internal
 
 import (
-	"encoding/json"
 	"fmt"
-	"net"
-	"runtime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
-func MPVSendCommand(ipcSocketPath string, command []interface{}) (interface{}, error) {
-    var conn net.Conn
-    var err error
+// Player controls an external media player playing a stream.
+// Players report progress as "property-change" events for time-pos, duration, pause and speed.
+type Player interface {
+	Start(streamURL string, title string) error
+	Seek(seconds int) error
+	Position() (float64, error)
+	Duration() (float64, error)
+	Speed() (float64, error)
+	SetSpeed(speed float64) error
+	SetPaused(paused bool) error
+	Quit() error
+	// Events is closed once the player exits
+	Events() <-chan PlayerEvent
+}
 
-    if runtime.GOOS == "windows" {
-        // Use named pipe for Windows
-        // conn, err = winio.DialPipe(ipcSocketPath, nil)
-    } else {
-        conn, err = net.Dial("unix", ipcSocketPath)
-    }
-    if err != nil {
-        return nil, err
-    }
-    defer conn.Close()
+// ValidatePlayerConfig checks the player settings before anything is streamed
+func ValidatePlayerConfig(config *ProgramConfig) error {
+	if _, err := NewPlayer(config); err != nil {
+		return err
+	}
+	switch config.Player {
+	case "", "mpv":
+		return validateMpvConfig(config)
+	case "vlc":
+		if _, err := exec.LookPath(config.VlcPath); err != nil {
+			return fmt.Errorf("vlc not found: %w", err)
+		}
+	}
+	return nil
+}
 
-    commandStr, err := json.Marshal(map[string]interface{}{
-        "command": command,
-    })
-    if err != nil {
-        return nil, err
-    }
+// NewPlayer returns the player selected in the config
+func NewPlayer(config *ProgramConfig) (Player, error) {
+	switch config.Player {
+	case "", "mpv":
+		return &MPVPlayer{}, nil
+	case "vlc":
+		return &VLCPlayer{Path: config.VlcPath}, nil
+	case "generic":
+		if config.PlayerCommand == "" {
+			return nil, fmt.Errorf("the generic player needs PlayerCommand to be set")
+		}
+		return &GenericPlayer{Command: config.PlayerCommand}, nil
+	}
+	return nil, fmt.Errorf("unknown player %q (expected mpv, vlc or generic)", config.Player)
+}
 
-    // Send the command
-    _, err = conn.Write(append(commandStr, '\n'))
-    if err != nil {
-        return nil, err
-    }
+// MPVPlayer runs mpv and controls it over its IPC socket
+type MPVPlayer struct {
+	SocketPath string
 
-    // Receive the response
-    buf := make([]byte, 4096)
-    n, err := conn.Read(buf)
-    if err != nil {
-        return nil, err
-    }
+	cmd          *exec.Cmd
+	client       *MPVClient
+	events       chan PlayerEvent
+	playlistFile string
+}
 
-    var response map[string]interface{}
-    if err := json.Unmarshal(buf[:n], &response); err != nil {
-        return nil, err
-    }
+// Start launches mpv on the stream and waits for its IPC socket
+func (p *MPVPlayer) Start(streamURL string, title string) error {
+	return p.launch("--force-media-title="+title, streamURL)
+}
 
-    if data, exists := response["data"]; exists {
-        return data, nil
-    }
+// launch runs mpv with the configured arguments followed by what to play
+func (p *MPVPlayer) launch(media ...string) error {
+	config := GetGlobalConfig()
 
-    return nil, nil
-}
+	// Create socket path with random component
+	p.SocketPath = filepath.Join("/tmp", fmt.Sprintf("buttercup-%x.sock", time.Now().UnixNano()))
 
-func SeekMPV(ipcSocketPath string, time int) (interface{}, error) {
-	command := []interface{}{"seek", time, "absolute"}
-	return MPVSendCommand(ipcSocketPath, command)
-}
+	args, err := MpvArgs(config, p.SocketPath)
+	if err != nil {
+		return err
+	}
+	if config.Autoplay && config.AutoplayCountdown > 0 {
+		// Stay open at the end so the autoplay countdown can be shown on the OSD
+		args = append(args, "--keep-open=yes")
+	}
+	args = append(args, media...)
 
-func GetMPVPausedStatus(ipcSocketPath string) (bool, error) {
-	status, err := MPVSendCommand(ipcSocketPath, []interface{}{"get_property", "pause"})
-	if err != nil || status == nil {
-		return false, err
+	p.cmd = exec.Command(config.MpvPath, args...)
+	if err := p.cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start mpv: %w", err)
 	}
+	Debug("Started mpv successfully, socket path: %s", p.SocketPath)
 
-	paused, ok := status.(bool)
-	if ok {
-		return paused, nil
+	client, err := ConnectMPV(p.SocketPath, 30*time.Second)
+	if err != nil {
+		p.cmd.Process.Kill()
+		p.cmd.Wait()
+		return err
+	}
+	for _, property := range []string{"time-pos", "duration", "pause", "speed", "eof-reached", "playlist-pos", "aid", "sid"} {
+		if err := client.ObserveProperty(property); err != nil {
+			Debug("Error observing %s: %v", property, err)
+		}
 	}
-	return false, nil
+	p.client = client
+
+	p.events = make(chan PlayerEvent)
+	go func() {
+		for event := range client.Events() {
+			p.events <- event
+		}
+		client.Close()
+		p.cmd.Wait()
+		if p.playlistFile != "" {
+			os.Remove(p.playlistFile)
+		}
+		close(p.events)
+	}()
+	return nil
 }
 
-func GetMPVPlaybackSpeed(ipcSocketPath string) (float64, error) {
-	speed, err := MPVSendCommand(ipcSocketPath, []interface{}{"get_property", "speed"})
-	if err != nil || speed == nil {
-		return 0, err
+// MpvArgs merges the configured mpv arguments and profile with the flags buttercup relies on
+func MpvArgs(config *ProgramConfig, socketPath string) ([]string, error) {
+	args, err := splitArgs(config.MpvArgs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MpvArgs: %w", err)
 	}
-
-	currentSpeed, ok := speed.(float64)
-	if ok {
-		return currentSpeed, nil
+	if config.MpvProfile != "" {
+		args = append(args, "--profile="+config.MpvProfile)
 	}
-
-	return 0, nil
+	if languages := ParseLanguageList(config.PreferredAudioLanguages); len(languages) > 0 {
+		args = append(args, "--alang="+mpvLanguageOption(languages))
+	}
+	if languages := ParseLanguageList(config.PreferredSubtitleLanguages); len(languages) > 0 {
+		args = append(args, "--slang="+mpvLanguageOption(languages))
+	}
+	// mpv uses the last value of an option, so these win over anything configured
+	return append(args,
+		"--force-seekable=yes",
+		"--input-ipc-server="+socketPath,
+	), nil
 }
 
-func GetPercentageWatched(ipcSocketPath string) (float64, error) {
-	currentTime, err := MPVSendCommand(ipcSocketPath, []interface{}{"get_property", "time-pos"})
-	if err != nil || currentTime == nil {
-		return 0, err
+// validateMpvConfig checks that mpv exists and accepts the configured arguments and profile
+func validateMpvConfig(config *ProgramConfig) error {
+	path, err := exec.LookPath(config.MpvPath)
+	if err != nil {
+		return fmt.Errorf("mpv not found: %w", err)
 	}
 
-	duration, err := MPVSendCommand(ipcSocketPath, []interface{}{"get_property", "duration"})
-	if err != nil || duration == nil {
-		return 0, err
+	args, err := splitArgs(config.MpvArgs)
+	if err != nil {
+		return fmt.Errorf("invalid MpvArgs: %w", err)
 	}
-
-	currTime, ok1 := currentTime.(float64)
-	dur, ok2 := duration.(float64)
-
-	if ok1 && ok2 && dur > 0 {
-		percentageWatched := (currTime / dur) * 100
-		return percentageWatched, nil
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--") {
+			return fmt.Errorf("invalid MpvArgs: %q is not an mpv option", arg)
+		}
+		if strings.HasPrefix(arg, "--input-ipc-server") {
+			return fmt.Errorf("invalid MpvArgs: %s is set by buttercup", arg)
+		}
+	}
+	if strings.ContainsAny(config.MpvProfile, " \t") {
+		return fmt.Errorf("invalid MpvProfile %q", config.MpvProfile)
 	}
 
-	return 0, nil
+	// mpv parses the whole command line before printing its version, so bad options fail here
+	check, err := MpvArgs(config, filepath.Join(os.TempDir(), "buttercup-check.sock"))
+	if err != nil {
+		return err
+	}
+	output, err := exec.Command(path, append(check, "--version")...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mpv rejected the configured arguments: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
 }
 
-func PercentageWatched(playbackTime int, duration int) float64 {
-	if duration > 0 {
-		percentage := (float64(playbackTime) / float64(duration)) * 100
-		return percentage
+// splitArgs splits a command line on whitespace, keeping quoted parts together
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArg := false
+
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
 	}
-	return float64(0)
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", line)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
 }
 
-// GetMPVPosition gets the current playback position
-func GetMPVPosition(socketPath string) (float64, error) {
-	return getMPVProperty(socketPath, "time-pos")
+// Client returns the IPC connection for mpv-only features
+func (p *MPVPlayer) Client() *MPVClient {
+	return p.client
 }
 
-// GetMPVDuration gets the total duration of the current file
-func GetMPVDuration(socketPath string) (float64, error) {
-	return getMPVProperty(socketPath, "duration")
+func (p *MPVPlayer) Seek(seconds int) error {
+	_, err := p.client.Command("seek", seconds, "absolute")
+	return err
 }
 
-// StopMPV stops the current playback
-func StopMPV(socketPath string) error {
-	conn, err := net.Dial("unix", socketPath)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
+func (p *MPVPlayer) Position() (float64, error) {
+	return p.floatProperty("time-pos")
+}
 
-	cmd := struct {
-		Command   []string `json:"command"`
-		RequestID int      `json:"request_id"`
-	}{
-		Command:   []string{"quit"},
-		RequestID: 1,
-	}
+func (p *MPVPlayer) Duration() (float64, error) {
+	return p.floatProperty("duration")
+}
 
-	return json.NewEncoder(conn).Encode(cmd)
+func (p *MPVPlayer) Speed() (float64, error) {
+	return p.floatProperty("speed")
 }
 
-// getMPVProperty is a helper function to get MPV properties
-func getMPVProperty(socketPath string, property string) (float64, error) {
-	conn, err := net.Dial("unix", socketPath)
-	if err != nil {
-		return 0, err
-	}
-	defer conn.Close()
+func (p *MPVPlayer) SetSpeed(speed float64) error {
+	return p.client.SetProperty("speed", speed)
+}
 
-	cmd := struct {
-		Command   []string `json:"command"`
-		RequestID int      `json:"request_id"`
-	}{
-		Command:   []string{"get_property", property},
-		RequestID: 1,
-	}
+func (p *MPVPlayer) SetPaused(paused bool) error {
+	return p.client.SetProperty("pause", paused)
+}
 
-	if err := json.NewEncoder(conn).Encode(cmd); err != nil {
-		return 0, err
-	}
+func (p *MPVPlayer) Quit() error {
+	_, err := p.client.Command("quit")
+	return err
+}
 
-	var response struct {
-		Data      float64 `json:"data"`
-		Error     string  `json:"error"`
-		RequestID int     `json:"request_id"`
-	}
+func (p *MPVPlayer) Events() <-chan PlayerEvent {
+	return p.events
+}
 
-	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+func (p *MPVPlayer) floatProperty(name string) (float64, error) {
+	value, err := p.client.GetProperty(name)
+	if err != nil {
 		return 0, err
 	}
-
-	if response.Error != "" {
-		return 0, fmt.Errorf("mpv error: %s", response.Error)
+	number, ok := value.(float64)
+	if !ok {
+		return 0, fmt.Errorf("mpv property %s is not a number", name)
 	}
+	return number, nil
+}
 
-	return response.Data, nil
+func PercentageWatched(playbackTime int, duration int) float64 {
+	if duration > 0 {
+		percentage := (float64(playbackTime) / float64(duration)) * 100
+		return percentage
+	}
+	return float64(0)
 }
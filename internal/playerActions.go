@@ -0,0 +1,44 @@
+package internal
+
+import "fmt"
+
+// Actions that can be triggered from inside mpv
+const (
+	ActionNextEpisode     = "next-episode"
+	ActionPreviousEpisode = "previous-episode"
+	ActionMarkWatched     = "mark-watched"
+	ActionEpisodeList     = "episode-list"
+	ActionStopAfter       = "stop-after-episode"
+	ActionSleepTimer      = "sleep-timer"
+	ActionReplay          = "replay"
+)
+
+// BindActionKeys binds the configured keys in mpv to buttercup's actions
+func BindActionKeys(client *MPVClient, config *ProgramConfig) error {
+	bindings := map[string]string{
+		ActionNextEpisode:     config.NextEpisodeKey,
+		ActionPreviousEpisode: config.PreviousEpisodeKey,
+		ActionMarkWatched:     config.MarkWatchedKey,
+		ActionEpisodeList:     config.EpisodeListKey,
+		ActionStopAfter:       config.StopAfterEpisodeKey,
+		ActionSleepTimer:      config.SleepTimerKey,
+		ActionReplay:          config.ReplayKey,
+	}
+	for action, key := range bindings {
+		if key == "" {
+			continue
+		}
+		if err := client.BindKey(key, "action", action); err != nil {
+			return fmt.Errorf("failed to bind %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// ParseAction returns the action a client-message asks for, if any
+func ParseAction(args []string) (string, bool) {
+	if len(args) < 3 || args[0] != "buttercup" || args[1] != "action" {
+		return "", false
+	}
+	return args[2], true
+}
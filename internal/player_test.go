@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"--fs", []string{"--fs"}},
+		{" --fs \t --volume=50 ", []string{"--fs", "--volume=50"}},
+		{`--title="My Show" --sub-font='Noto Sans'`, []string{"--title=My Show", "--sub-font=Noto Sans"}},
+		{`--title="it's"`, []string{"--title=it's"}},
+		{`--title=""`, []string{"--title="}},
+		{`"" --fs`, []string{"", "--fs"}},
+	}
+	for _, test := range tests {
+		got, err := splitArgs(test.line)
+		if err != nil {
+			t.Errorf("%q: %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.line, got, test.want)
+		}
+	}
+
+	for _, line := range []string{`--title="My Show`, `--sub-font='Noto`, `"`} {
+		if _, err := splitArgs(line); err == nil || !strings.Contains(err.Error(), "unterminated quote") {
+			t.Errorf("%q: got error %v, want an unterminated quote", line, err)
+		}
+	}
+}
+
+func TestMpvArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ProgramConfig
+		want   []string
+	}{
+		{"defaults", ProgramConfig{}, []string{
+			"--force-seekable=yes", "--input-ipc-server=/tmp/mpv.sock"}},
+		{"configured arguments and profile", ProgramConfig{MpvArgs: `--fs --title="My Show"`, MpvProfile: "anime"}, []string{
+			"--fs", "--title=My Show", "--profile=anime", "--force-seekable=yes", "--input-ipc-server=/tmp/mpv.sock"}},
+		{"languages", ProgramConfig{PreferredAudioLanguages: "jpn", PreferredSubtitleLanguages: "eng"}, []string{
+			"--alang=jpn,ja,jp", "--slang=eng,en", "--force-seekable=yes", "--input-ipc-server=/tmp/mpv.sock"}},
+		// The socket buttercup connects to comes last, so mpv uses it over a configured one
+		{"configured socket", ProgramConfig{MpvArgs: "--input-ipc-server=/tmp/other.sock"}, []string{
+			"--input-ipc-server=/tmp/other.sock", "--force-seekable=yes", "--input-ipc-server=/tmp/mpv.sock"}},
+	}
+	for _, test := range tests {
+		got, err := MpvArgs(&test.config, "/tmp/mpv.sock")
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	if _, err := MpvArgs(&ProgramConfig{MpvArgs: `--title="My Show`}, "/tmp/mpv.sock"); err == nil {
+		t.Error("expected an error for an unterminated quote")
+	}
+}
+
+func TestValidateMpvConfig(t *testing.T) {
+	// A stand-in for mpv that rejects one option
+	mpv := filepath.Join(t.TempDir(), "mpv")
+	script := "#!/bin/sh\nfor arg; do\n\tif [ \"$arg\" = --no-such-option ]; then\n\t\techo \"Error parsing option\"\n\t\texit 1\n\tfi\ndone\n"
+	if err := os.WriteFile(mpv, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config ProgramConfig
+		err    string
+	}{
+		{"defaults", ProgramConfig{}, ""},
+		{"valid arguments and profile", ProgramConfig{MpvArgs: `--fs --title="My Show"`, MpvProfile: "anime"}, ""},
+		{"missing mpv", ProgramConfig{MpvPath: filepath.Join(t.TempDir(), "mpv")}, "mpv not found"},
+		{"unterminated quote", ProgramConfig{MpvArgs: `--title="My Show`}, "unterminated quote"},
+		{"not an option", ProgramConfig{MpvArgs: "--fs video.mkv"}, "is not an mpv option"},
+		{"socket set by buttercup", ProgramConfig{MpvArgs: "--input-ipc-server=/tmp/other.sock"}, "is set by buttercup"},
+		{"profile with spaces", ProgramConfig{MpvProfile: "my anime"}, "invalid MpvProfile"},
+		{"rejected by mpv", ProgramConfig{MpvArgs: "--no-such-option"}, "Error parsing option"},
+	}
+	for _, test := range tests {
+		config := test.config
+		if config.MpvPath == "" {
+			config.MpvPath = mpv
+		}
+		err := validateMpvConfig(&config)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EpisodePlaylist is the sorted list of a torrent's episodes loaded into mpv as one playlist
+type EpisodePlaylist struct {
+	Episodes []TorrentFileInfo
+}
+
+// SortedEpisodes returns the files with an episode number in season/episode order
+func SortedEpisodes(files []TorrentFileInfo) []TorrentFileInfo {
+	fileNames := make([]string, len(files))
+	for i, file := range files {
+		fileNames[i] = file.DisplayName
+	}
+
+	var sorted []TorrentFileInfo
+	for _, name := range FindAndSortEpisodes(fileNames) {
+		for _, file := range files {
+			if file.DisplayName == name {
+				sorted = append(sorted, file)
+				break
+			}
+		}
+	}
+	return sorted
+}
+
+// NewEpisodePlaylist lists the episodes that webtorrent can serve directly, leaving out videos inside archives
+func NewEpisodePlaylist(files []TorrentFileInfo) *EpisodePlaylist {
+	playlist := &EpisodePlaylist{}
+	for _, file := range SortedEpisodes(files) {
+		if file.Archive == nil {
+			playlist.Episodes = append(playlist.Episodes, file)
+		}
+	}
+	return playlist
+}
+
+// Position returns where a file is in the playlist
+func (p *EpisodePlaylist) Position(fileIndex int) (int, bool) {
+	for i, file := range p.Episodes {
+		if file.ActualIndex == fileIndex {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// File returns the episode at a playlist position
+func (p *EpisodePlaylist) File(position int) (TorrentFileInfo, bool) {
+	if position < 0 || position >= len(p.Episodes) {
+		return TorrentFileInfo{}, false
+	}
+	return p.Episodes[position], true
+}
+
+// StreamTorrentPlaylist streams the torrent and opens all its episodes in mpv, starting at current
+func StreamTorrentPlaylist(magnetURI string, files []TorrentFileInfo, current TorrentFileInfo) (*MPVPlayer, *EpisodePlaylist, error) {
+	playlist := NewEpisodePlaylist(files)
+	start, ok := playlist.Position(current.ActualIndex)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s can't be played in a playlist", current.DisplayName)
+	}
+
+	streamURL, err := StartStream(magnetURI, current)
+	if err != nil {
+		return nil, nil, err
+	}
+	infoHash, err := webtorrentInfoHash(streamURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// webtorrent serves every file of the torrent, fetching the pieces of whichever is requested
+	var m3u strings.Builder
+	m3u.WriteString("#EXTM3U\n")
+	for _, file := range playlist.Episodes {
+		fmt.Fprintf(&m3u, "#EXTINF:-1,%s\n%s\n", file.DisplayName, webtorrentFileURL(infoHash, file.Path))
+	}
+
+	playlistFile := filepath.Join("/tmp", fmt.Sprintf("buttercup-%x.m3u", time.Now().UnixNano()))
+	if err := os.WriteFile(playlistFile, []byte(m3u.String()), 0644); err != nil {
+		return nil, nil, fmt.Errorf("failed to write playlist: %w", err)
+	}
+
+	player := &MPVPlayer{playlistFile: playlistFile}
+	if err := player.launch("--playlist="+playlistFile, fmt.Sprintf("--playlist-start=%d", start)); err != nil {
+		os.Remove(playlistFile)
+		return nil, nil, err
+	}
+	return player, playlist, nil
+}
+
+// webtorrentInfoHash takes the info hash out of a webtorrent stream URL
+func webtorrentInfoHash(streamURL string) (string, error) {
+	_, rest, found := strings.Cut(streamURL, "/webtorrent/")
+	if !found {
+		return "", fmt.Errorf("not a webtorrent stream: %s", streamURL)
+	}
+	infoHash, _, _ := strings.Cut(rest, "/")
+	return infoHash, nil
+}
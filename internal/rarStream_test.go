@@ -0,0 +1,352 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rar4Volume builds a RAR4 volume with a single stored file, CRCs are left at zero as they aren't checked
+func rar4Volume(name string, continuedFrom, continuesIn bool, size int64, data []byte) []byte {
+	volume := append([]byte{}, rar4Signature...)
+	// Archive header
+	volume = append(volume, 0, 0, 0x73, 0, 0, 13, 0, 0, 0, 0, 0, 0, 0)
+
+	var flags uint16 = 0x8000
+	if continuedFrom {
+		flags |= 0x01
+	}
+	if continuesIn {
+		flags |= 0x02
+	}
+	header := make([]byte, 32+len(name))
+	header[2] = 0x74
+	binary.LittleEndian.PutUint16(header[3:], flags)
+	binary.LittleEndian.PutUint16(header[5:], uint16(len(header)))
+	binary.LittleEndian.PutUint32(header[7:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(header[11:], uint32(size))
+	header[25] = 0x30
+	binary.LittleEndian.PutUint16(header[26:], uint16(len(name)))
+	copy(header[32:], name)
+	volume = append(volume, header...)
+	volume = append(volume, data...)
+
+	// End of archive
+	return append(volume, 0, 0, 0x7b, 0, 0, 7, 0)
+}
+
+func appendRarVint(data []byte, value uint64) []byte {
+	for value >= 0x80 {
+		data = append(data, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(data, byte(value))
+}
+
+// rar5Block builds a RAR5 header with its size fields filled in
+func rar5Block(headerType uint64, headerFlags uint64, body []byte, dataSize uint64) []byte {
+	inner := appendRarVint(nil, headerType)
+	if dataSize > 0 {
+		headerFlags |= 0x02
+	}
+	inner = appendRarVint(inner, headerFlags)
+	if dataSize > 0 {
+		inner = appendRarVint(inner, dataSize)
+	}
+	inner = append(inner, body...)
+
+	block := make([]byte, 4)
+	block = appendRarVint(block, uint64(len(inner)))
+	return append(block, inner...)
+}
+
+// rar5FileBody builds the fields of a RAR5 file header for a stored file
+func rar5FileBody(name string, nameLength uint64, size int64) []byte {
+	body := appendRarVint(nil, 0)            // File flags
+	body = appendRarVint(body, uint64(size)) // Unpacked size
+	body = appendRarVint(body, 0)            // Attributes
+	body = appendRarVint(body, 0)            // Compression
+	body = appendRarVint(body, 0)            // Host OS
+	body = appendRarVint(body, nameLength)
+	return append(body, name...)
+}
+
+// rar5Volume builds a RAR5 volume with a single stored file
+func rar5Volume(name string, continuedFrom, continuesIn bool, size int64, data []byte) []byte {
+	var flags uint64
+	if continuedFrom {
+		flags |= 0x08
+	}
+	if continuesIn {
+		flags |= 0x10
+	}
+	volume := append([]byte{}, rar5Signature...)
+	volume = append(volume, rar5Block(1, 0, appendRarVint(nil, 1), 0)...)
+	volume = append(volume, rar5Block(2, flags, rar5FileBody(name, uint64(len(name)), size), uint64(len(data)))...)
+	volume = append(volume, data...)
+	return append(volume, rar5Block(5, 0, appendRarVint(nil, 0), 0)...)
+}
+
+var rarFormats = []struct {
+	name   string
+	volume func(name string, continuedFrom, continuesIn bool, size int64, data []byte) []byte
+}{
+	{"RAR4", rar4Volume},
+	{"RAR5", rar5Volume},
+}
+
+// testRarVideo returns recognizable bytes standing in for a video
+func testRarVideo(size int) []byte {
+	video := make([]byte, size)
+	for i := range video {
+		video[i] = byte(i * 7)
+	}
+	return video
+}
+
+// serveRarVolumes serves the volumes like webtorrent would and returns an archive of them
+// laid out the way findRarArchives does it
+func serveRarVolumes(t *testing.T, volumes [][]byte) *RarArchive {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var i int
+		if _, err := fmt.Sscanf(r.URL.Path, "/show.r%02d", &i); err != nil || i >= len(volumes) {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(volumes[i]))
+	}))
+	t.Cleanup(server.Close)
+
+	entries, err := parseRarVolume(volumes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries in the first volume", len(entries))
+	}
+	entry := entries[0]
+	archive := &RarArchive{Name: path.Base(entry.Name), Size: entry.UnpackedSize}
+	for i, volume := range volumes {
+		name := fmt.Sprintf("show.r%02d", i)
+		archive.Volumes = append(archive.Volumes, RarVolume{
+			Path:   name,
+			Index:  i,
+			URL:    server.URL + "/" + name,
+			Length: int64(len(volume)),
+		})
+	}
+	archive.Volumes[0].DataOffset = entry.DataOffset
+	archive.Volumes[0].DataLength = entry.PackedSize
+	return archive
+}
+
+// readRarArchive reads the inner file from offset to the end
+func readRarArchive(t *testing.T, archive *RarArchive, offset int64) []byte {
+	t.Helper()
+	reader := &rarStreamReader{archive: archive}
+	defer reader.Close()
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRarSingleVolume(t *testing.T) {
+	video := testRarVideo(300)
+	for _, format := range rarFormats {
+		t.Run(format.name, func(t *testing.T) {
+			volume := format.volume("Show\\Show.S01E01.mkv", false, false, int64(len(video)), video)
+			entries, err := parseRarVolume(volume)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("got %d entries", len(entries))
+			}
+			entry := entries[0]
+			if format.name == "RAR4" && entry.Name != "Show/Show.S01E01.mkv" {
+				t.Errorf("got name %q, want the path with forward slashes", entry.Name)
+			}
+			if !entry.Stored || entry.Encrypted || entry.Directory || entry.ContinuedFrom || entry.ContinuesIn ||
+				entry.UnpackedSize != 300 || entry.PackedSize != 300 {
+				t.Errorf("unexpected entry %+v", entry)
+			}
+			if data := volume[entry.DataOffset : entry.DataOffset+entry.PackedSize]; !bytes.Equal(data, video) {
+				t.Errorf("data offset %d does not point at the file", entry.DataOffset)
+			}
+
+			archive := serveRarVolumes(t, [][]byte{volume})
+			if err := archive.prepareLayout(); err != nil {
+				t.Fatal(err)
+			}
+			if data := readRarArchive(t, archive, 0); !bytes.Equal(data, video) {
+				t.Errorf("read %d bytes that differ from the video", len(data))
+			}
+		})
+	}
+}
+
+func TestRarMultiVolume(t *testing.T) {
+	video := testRarVideo(250)
+	for _, format := range rarFormats {
+		t.Run(format.name, func(t *testing.T) {
+			size := int64(len(video))
+			volumes := [][]byte{
+				format.volume("Show.S01E01.mkv", false, true, size, video[:100]),
+				format.volume("Show.S01E01.mkv", true, true, size, video[100:200]),
+				format.volume("Show.S01E01.mkv", true, false, size, video[200:]),
+			}
+			archive := serveRarVolumes(t, volumes)
+			if err := archive.prepareLayout(); err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range []int64{100, 100, 50} {
+				if volume := archive.Volumes[i]; volume.DataLength != want {
+					t.Errorf("volume %d holds %d bytes, want %d", i, volume.DataLength, want)
+				}
+			}
+
+			if data := readRarArchive(t, archive, 0); !bytes.Equal(data, video) {
+				t.Errorf("read %d bytes that differ from the video", len(data))
+			}
+			if data := readRarArchive(t, archive, 150); !bytes.Equal(data, video[150:]) {
+				t.Errorf("read %d bytes from the middle that differ from the video", len(data))
+			}
+		})
+	}
+}
+
+func TestRarMultiVolumeOversizedHeader(t *testing.T) {
+	video := testRarVideo(250)
+	for _, format := range rarFormats {
+		t.Run(format.name, func(t *testing.T) {
+			size := int64(len(video))
+			// The second volume says it holds more than the file has
+			second := format.volume("Show.S01E01.mkv", true, true, size, testRarVideo(1000))
+			volumes := [][]byte{
+				format.volume("Show.S01E01.mkv", false, true, size, video[:100]),
+				second[:len(second)-900],
+				format.volume("Show.S01E01.mkv", true, false, size, video[200:]),
+			}
+			if err := serveRarVolumes(t, volumes).prepareLayout(); err == nil {
+				t.Error("expected an error for a volume shorter than its header")
+			}
+		})
+	}
+}
+
+func TestRarTruncatedVolume(t *testing.T) {
+	for _, format := range rarFormats {
+		t.Run(format.name, func(t *testing.T) {
+			volume := format.volume("Show.S01E01.mkv", false, false, 300, testRarVideo(300))
+			full, err := parseRarVolume(volume)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Only the start of a volume is read, a header cut off by the end of it is left out
+			for size := len(volume) - 1; size >= 0; size-- {
+				entries, err := parseRarVolume(volume[:size])
+				if err != nil && !strings.Contains(err.Error(), "not a RAR volume") {
+					t.Errorf("cut at %d: %v", size, err)
+				}
+				if len(entries) > 0 && entries[0] != full[0] {
+					t.Errorf("cut at %d: got entry %+v", size, entries[0])
+				}
+			}
+		})
+	}
+}
+
+func TestRar4InvalidHeaders(t *testing.T) {
+	// The file header follows the signature and the archive header
+	const fileHeader = 7 + 13
+	volume := rar4Volume("Show.S01E01.mkv", false, false, 300, testRarVideo(300))
+	large := rar4Volume("Show.S01E01.mkv", false, false, 300, testRarVideo(300))
+	// Large files have the high halves of both sizes before the name
+	large = append(large[:fileHeader+32], append(make([]byte, 8), large[fileHeader+32:]...)...)
+	large[fileHeader+4] |= 0x01
+	binary.LittleEndian.PutUint16(large[fileHeader+5:], uint16(32+8+len("Show.S01E01.mkv")))
+
+	tests := []struct {
+		name   string
+		volume []byte
+		patch  func(header []byte)
+	}{
+		{"header size below 7", volume, func(header []byte) {
+			binary.LittleEndian.PutUint16(header[5:], 3)
+		}},
+		{"file header too short for its fields", volume, func(header []byte) {
+			binary.LittleEndian.PutUint16(header[5:], 20)
+		}},
+		{"name longer than the header", volume, func(header []byte) {
+			binary.LittleEndian.PutUint16(header[26:], 200)
+		}},
+		{"packed size past int64", large, func(header []byte) {
+			binary.LittleEndian.PutUint32(header[32:], math.MaxUint32)
+		}},
+		{"packed size overflowing the position", large, func(header []byte) {
+			binary.LittleEndian.PutUint32(header[7:], math.MaxUint32)
+			binary.LittleEndian.PutUint32(header[32:], math.MaxInt32)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			volume := append([]byte{}, test.volume...)
+			test.patch(volume[fileHeader:])
+			if entries, err := parseRarVolume(volume); err == nil {
+				t.Errorf("expected an error, got %+v", entries)
+			}
+		})
+	}
+
+	if entries, err := parseRarVolume(large); err != nil || len(entries) != 1 || entries[0].PackedSize != 300 {
+		t.Errorf("failed to parse a large file header: %+v, %v", entries, err)
+	}
+}
+
+func TestRar5InvalidHeaders(t *testing.T) {
+	archiveHeader := rar5Block(1, 0, appendRarVint(nil, 1), 0)
+	rawHeader := func(inner ...[]byte) []byte {
+		block := make([]byte, 4)
+		block = appendRarVint(block, uint64(len(bytes.Join(inner, nil))))
+		return append(block, bytes.Join(inner, nil)...)
+	}
+
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{"empty header", append(make([]byte, 4), 0, 0, 0)},
+		{"header larger than the format allows", appendRarVint(make([]byte, 4), 3*1024*1024)},
+		{"header size past int64", append(make([]byte, 4), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 0, 0)},
+		{"extra area larger than the header", rawHeader(
+			appendRarVint(nil, 2), appendRarVint(nil, 0x01), appendRarVint(nil, 200),
+			rar5FileBody("Show.S01E01.mkv", 15, 300))},
+		{"name longer than the header", rar5Block(2, 0, rar5FileBody("Show.S01E01.mkv", 200, 300), 300)},
+		{"name length overflowing the position", rar5Block(2, 0, rar5FileBody("Show.S01E01.mkv", math.MaxInt64, 300), 300)},
+		{"data size overflowing the position", rar5Block(2, 0, rar5FileBody("Show.S01E01.mkv", 15, 300), math.MaxInt64)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			volume := append(append([]byte{}, rar5Signature...), archiveHeader...)
+			volume = append(volume, test.header...)
+			volume = append(volume, testRarVideo(300)...)
+			if entries, err := parseRarVolume(volume); err == nil {
+				t.Errorf("expected an error, got %+v", entries)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+)
+
+// sleepTimerSteps are the durations the sleep timer key cycles through, ending with off
+var sleepTimerSteps = []time.Duration{15 * time.Minute, 30 * time.Minute, 45 * time.Minute, time.Hour, 90 * time.Minute, 0}
+
+// SessionLimits stops autoplay after a number of episodes, at a time or at the end of the season
+type SessionLimits struct {
+	MaxEpisodes      int       // Episodes to finish before stopping, 0 for no limit
+	Deadline         time.Time // When the sleep timer ends, zero for none
+	SeasonEnd        bool      // Stop before an episode of another season
+	StopAfterCurrent bool      // Stop once the playing episode ends
+
+	finished int
+}
+
+// NewSessionLimits sets up the limits from the command line, with sleep counted from now
+func NewSessionLimits(maxEpisodes int, sleep time.Duration, seasonEnd bool) *SessionLimits {
+	limits := &SessionLimits{MaxEpisodes: maxEpisodes, SeasonEnd: seasonEnd}
+	if sleep > 0 {
+		limits.Deadline = time.Now().Add(sleep)
+	}
+	return limits
+}
+
+// Expired reports whether the sleep timer has run out
+func (l *SessionLimits) Expired() bool {
+	return !l.Deadline.IsZero() && time.Now().After(l.Deadline)
+}
+
+// EpisodeFinished counts an episode watched to the end
+func (l *SessionLimits) EpisodeFinished() {
+	l.finished++
+}
+
+// StopBefore returns why autoplay should stop instead of going from current to next, if it should
+func (l *SessionLimits) StopBefore(current TorrentFileInfo, next TorrentFileInfo) (string, bool) {
+	switch {
+	case l.StopAfterCurrent:
+		return "Stopping after this episode as requested", true
+	case l.Expired():
+		return "Sleep timer ended", true
+	case l.MaxEpisodes > 0 && l.finished >= l.MaxEpisodes:
+		return fmt.Sprintf("Stopping after %d episode(s)", l.finished), true
+	}
+
+	if l.SeasonEnd {
+		currentSeason, _, ok := ParseEpisodeNumber(current.FileName())
+		nextSeason, _, nextOk := ParseEpisodeNumber(next.FileName())
+		if ok && nextOk && currentSeason != nextSeason {
+			return fmt.Sprintf("Reached the end of season %d", currentSeason), true
+		}
+	}
+	return "", false
+}
+
+// ToggleStopAfterCurrent switches stopping after the playing episode on or off and describes the result
+func (l *SessionLimits) ToggleStopAfterCurrent() string {
+	l.StopAfterCurrent = !l.StopAfterCurrent
+	if l.StopAfterCurrent {
+		return "Stopping after this episode"
+	}
+	return "Continuing after this episode"
+}
+
+// CycleSleepTimer moves the sleep timer to the next step after the time left and describes the result
+func (l *SessionLimits) CycleSleepTimer() string {
+	left := time.Duration(0)
+	if !l.Deadline.IsZero() && !l.Expired() {
+		left = time.Until(l.Deadline)
+	}
+
+	next := sleepTimerSteps[0]
+	if left > 0 {
+		next = 0
+		// Round up so pressing again right after setting a step moves on to the next one
+		for _, step := range sleepTimerSteps {
+			if step >= left+time.Minute {
+				next = step
+				break
+			}
+		}
+	}
+
+	if next == 0 {
+		l.Deadline = time.Time{}
+		return "Sleep timer off"
+	}
+	l.Deadline = time.Now().Add(next)
+	return fmt.Sprintf("Sleep timer: %d minutes", int(next.Minutes()))
+}
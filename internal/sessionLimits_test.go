@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionLimitsStopBefore(t *testing.T) {
+	episode := func(path string) TorrentFileInfo {
+		return TorrentFileInfo{DisplayName: path + " (1.2 GB)", Path: path}
+	}
+	// Batch folders name the whole range, only the file name says which season an episode is in
+	const batch = "Show.S01E01-S02E12.1080p/"
+
+	tests := []struct {
+		name    string
+		limits  SessionLimits
+		current TorrentFileInfo
+		next    TorrentFileInfo
+		want    string
+	}{
+		{"no limits", SessionLimits{}, episode("Show.S01E01.mkv"), episode("Show.S01E02.mkv"), ""},
+		{"stop after current", SessionLimits{StopAfterCurrent: true}, episode("Show.S01E01.mkv"), episode("Show.S01E02.mkv"),
+			"Stopping after this episode as requested"},
+		{"sleep timer ended", SessionLimits{Deadline: time.Now().Add(-time.Minute)}, episode("Show.S01E01.mkv"), episode("Show.S01E02.mkv"),
+			"Sleep timer ended"},
+		{"sleep timer running", SessionLimits{Deadline: time.Now().Add(time.Hour)}, episode("Show.S01E01.mkv"), episode("Show.S01E02.mkv"), ""},
+		{"episode limit reached", SessionLimits{MaxEpisodes: 2, finished: 2}, episode("Show.S01E02.mkv"), episode("Show.S01E03.mkv"),
+			"Stopping after 2 episode(s)"},
+		{"episode limit not reached", SessionLimits{MaxEpisodes: 2, finished: 1}, episode("Show.S01E01.mkv"), episode("Show.S01E02.mkv"), ""},
+		{"season end", SessionLimits{SeasonEnd: true}, episode("Show.S01E12.mkv"), episode("Show.S02E01.mkv"),
+			"Reached the end of season 1"},
+		{"same season", SessionLimits{SeasonEnd: true}, episode("Show.S01E11.mkv"), episode("Show.S01E12.mkv"), ""},
+		{"season end in a batch folder", SessionLimits{SeasonEnd: true}, episode(batch + "Show.S01E12.mkv"), episode(batch + "Show.S02E01.mkv"),
+			"Reached the end of season 1"},
+		{"season end without seasons", SessionLimits{SeasonEnd: true}, episode("Show - 12.mkv"), episode("Show - 13.mkv"), ""},
+		// Resolutions don't count as seasons either
+		{"season end without seasons at 1080p", SessionLimits{SeasonEnd: true},
+			episode("Show - 12 [1920x1080].mkv"), episode("Show - 13 [1280x720].mkv"), ""},
+		{"season end only", SessionLimits{}, episode("Show.S01E12.mkv"), episode("Show.S02E01.mkv"), ""},
+	}
+	for _, test := range tests {
+		reason, stop := test.limits.StopBefore(test.current, test.next)
+		if reason != test.want || stop != (test.want != "") {
+			t.Errorf("%s: got %q, %v, want %q", test.name, reason, stop, test.want)
+		}
+	}
+}
+
+func TestSessionLimitsCycleSleepTimer(t *testing.T) {
+	tests := []struct {
+		name string
+		left time.Duration // Time left on the running timer, 0 for none
+		want time.Duration // 0 for off
+		msg  string
+	}{
+		{"off", 0, 15 * time.Minute, "Sleep timer: 15 minutes"},
+		{"expired", -time.Minute, 15 * time.Minute, "Sleep timer: 15 minutes"},
+		// Pressing again right after setting a step moves on
+		{"just set to 15", 15 * time.Minute, 30 * time.Minute, "Sleep timer: 30 minutes"},
+		{"just set to 60", time.Hour, 90 * time.Minute, "Sleep timer: 90 minutes"},
+		{"just set to 90", 90 * time.Minute, 0, "Sleep timer off"},
+		// The time left is rounded up to the next step with a minute to spare
+		{"10 minutes left", 10 * time.Minute, 15 * time.Minute, "Sleep timer: 15 minutes"},
+		{"14 and a half minutes left", 14*time.Minute + 30*time.Second, 30 * time.Minute, "Sleep timer: 30 minutes"},
+		{"40 minutes left", 40 * time.Minute, 45 * time.Minute, "Sleep timer: 45 minutes"},
+	}
+	for _, test := range tests {
+		limits := &SessionLimits{}
+		if test.left != 0 {
+			limits.Deadline = time.Now().Add(test.left)
+		}
+		if msg := limits.CycleSleepTimer(); msg != test.msg {
+			t.Errorf("%s: got %q, want %q", test.name, msg, test.msg)
+		}
+		switch {
+		case test.want == 0 && !limits.Deadline.IsZero():
+			t.Errorf("%s: the timer is still set to %v", test.name, time.Until(limits.Deadline))
+		case test.want != 0:
+			if left := time.Until(limits.Deadline); left > test.want || left < test.want-time.Second {
+				t.Errorf("%s: got %v left, want %v", test.name, left, test.want)
+			}
+		}
+	}
+
+	// Cycling from off goes through every step and back to off
+	limits := &SessionLimits{}
+	for _, step := range sleepTimerSteps {
+		limits.CycleSleepTimer()
+		if left := time.Until(limits.Deadline); step == 0 && !limits.Deadline.IsZero() || step != 0 && (left > step || left < step-time.Second) {
+			t.Errorf("got %v left, want the %v step", left, step)
+		}
+	}
+}
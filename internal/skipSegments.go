@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+)
+
+// SkipSegment is a part of an episode, like the intro, that the user marked for skipping
+type SkipSegment struct {
+	Start float64
+	End   float64
+}
+
+// IsSet reports whether the segment has been recorded
+func (s SkipSegment) IsSet() bool {
+	return s.End > s.Start
+}
+
+// SegmentSkipper records intro/outro segments from mpv key presses and skips them in later episodes
+type SegmentSkipper struct {
+	client       *MPVClient
+	databaseFile string
+	magnetURI    string
+	tolerance    float64
+
+	intro    SkipSegment
+	outro    SkipSegment
+	duration float64
+	marking  map[string]float64
+	skipped  map[string]bool
+}
+
+// NewSegmentSkipper loads the show's recorded segments and binds the keys to mark new ones
+func NewSegmentSkipper(client *MPVClient, databaseFile string, magnetURI string, config *ProgramConfig) (*SegmentSkipper, error) {
+	skipper := &SegmentSkipper{
+		client:       client,
+		databaseFile: databaseFile,
+		magnetURI:    magnetURI,
+		tolerance:    float64(config.SkipSegmentTolerance),
+		marking:      make(map[string]float64),
+		skipped:      make(map[string]bool),
+	}
+	if torrent := LocalGetTorrent(databaseFile, magnetURI); torrent != nil {
+		skipper.intro = torrent.Intro
+		skipper.outro = torrent.Outro
+	}
+
+	if err := client.BindKey(config.IntroMarkKey, "mark-segment", "intro"); err != nil {
+		return nil, fmt.Errorf("failed to bind %s: %w", config.IntroMarkKey, err)
+	}
+	if err := client.BindKey(config.OutroMarkKey, "mark-segment", "outro"); err != nil {
+		return nil, fmt.Errorf("failed to bind %s: %w", config.OutroMarkKey, err)
+	}
+	return skipper, nil
+}
+
+// Update skips a recorded segment when playback reaches its start.
+// Landing in a segment later than the tolerance (e.g. by seeking back into it) plays it.
+func (s *SegmentSkipper) Update(position float64) {
+	for name, segment := range s.absoluteSegments() {
+		if s.skipped[name] || position < segment.Start || position > segment.Start+s.tolerance {
+			continue
+		}
+		s.skipped[name] = true
+		Debug("Skipping %s from %.1f to %.1f", name, position, segment.End)
+		if _, err := s.client.Command("seek", segment.End, "absolute"); err != nil {
+			Debug("Error skipping %s: %v", name, err)
+			continue
+		}
+		s.client.ShowText("Skipped "+name, 2*time.Second)
+	}
+}
+
+// HandleMessage marks the start or end of a segment, returning false for other messages
+func (s *SegmentSkipper) HandleMessage(args []string) bool {
+	if len(args) < 3 || args[0] != "buttercup" || args[1] != "mark-segment" {
+		return false
+	}
+	name := args[2]
+	if name != "intro" && name != "outro" {
+		return true
+	}
+
+	position, err := s.property("time-pos")
+	if err != nil {
+		Debug("Error reading position to mark %s: %v", name, err)
+		return true
+	}
+
+	start, marking := s.marking[name]
+	if !marking {
+		s.marking[name] = position
+		s.client.ShowText(fmt.Sprintf("Marked %s start at %s, press again at its end", name, formatDuration(position)), 3*time.Second)
+		return true
+	}
+	delete(s.marking, name)
+
+	if position <= start {
+		s.client.ShowText(fmt.Sprintf("The %s has to end after it starts, not saved", name), 3*time.Second)
+		return true
+	}
+	if err := s.save(name, SkipSegment{Start: start, End: position}); err != nil {
+		Debug("Error saving %s: %v", name, err)
+		s.client.ShowText(fmt.Sprintf("Failed to save %s", name), 3*time.Second)
+		return true
+	}
+	s.client.ShowText(fmt.Sprintf("Saved %s %s–%s, it will be skipped in the next episodes",
+		name, formatDuration(start), formatDuration(position)), 3*time.Second)
+	return true
+}
+
+// save stores a segment for the show, keeping outros relative to the end of the episode
+func (s *SegmentSkipper) save(name string, segment SkipSegment) error {
+	if name == "outro" {
+		duration, err := s.episodeDuration()
+		if err != nil {
+			return err
+		}
+		segment = SkipSegment{Start: segment.Start - duration, End: segment.End - duration}
+		s.outro = segment
+	} else {
+		s.intro = segment
+	}
+	// Don't skip what was just marked
+	s.skipped[name] = true
+
+	return LocalUpdateTorrentSettings(s.databaseFile, s.magnetURI, func(torrent *TorrentData) {
+		if name == "outro" {
+			torrent.Outro = segment
+		} else {
+			torrent.Intro = segment
+		}
+	})
+}
+
+// absoluteSegments returns the recorded segments as positions in the playing episode
+func (s *SegmentSkipper) absoluteSegments() map[string]SkipSegment {
+	segments := make(map[string]SkipSegment)
+	if s.intro.IsSet() {
+		segments["intro"] = s.intro
+	}
+	if s.outro.IsSet() {
+		if duration, err := s.episodeDuration(); err == nil {
+			segments["outro"] = SkipSegment{Start: duration + s.outro.Start, End: duration + s.outro.End}
+		}
+	}
+	return segments
+}
+
+// episodeDuration reads the duration once instead of on every position update
+func (s *SegmentSkipper) episodeDuration() (float64, error) {
+	if s.duration > 0 {
+		return s.duration, nil
+	}
+	duration, err := s.property("duration")
+	if err != nil {
+		return 0, err
+	}
+	s.duration = duration
+	return duration, nil
+}
+
+func (s *SegmentSkipper) property(name string) (float64, error) {
+	value, err := s.client.GetProperty(name)
+	if err != nil {
+		return 0, err
+	}
+	number, ok := value.(float64)
+	if !ok {
+		return 0, fmt.Errorf("mpv property %s is not a number", name)
+	}
+	return number, nil
+}
+
+// formatDuration formats seconds as m:ss
+func formatDuration(seconds float64) string {
+	total := int(seconds)
+	return fmt.Sprintf("%d:%02d", total/60, total%60)
+}
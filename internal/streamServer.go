@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+)
+
+var currentStreamServer *StreamServer
+
+// StreamServer exposes a stream to players on other machines and optionally tracks how far they got
+type StreamServer struct {
+	URL          string
+	LocalURL     string
+	Title        string
+	MagnetURI    string
+	FileIndex    int
+	DatabaseFile string
+	Files        []TorrentFileInfo
+
+	track     bool
+	server    *http.Server
+	progress  streamProgress
+	mu        sync.Mutex
+	completed bool
+}
+
+// streamProgress follows how far into a file players have read from the start.
+// Players also read ahead of where they are, e.g. the index at the end of MKV and MP4 files when opening them,
+// so reads starting well past what was read so far don't count until playback catches up.
+type streamProgress struct {
+	mu      sync.Mutex
+	reached int64
+}
+
+// streamProgressGap is how far (in percent of the file) a read may start past the part read so far
+// and still count, enough for seeking over an opening
+const streamProgressGap = 10
+
+// add records that bytes start to end of a file of total bytes were read and returns the percentage read
+func (p *streamProgress) add(start int64, end int64, total int64) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if start <= p.reached+total*streamProgressGap/100 && end > p.reached {
+		p.reached = end
+	}
+	return float64(p.reached) / float64(total) * 100
+}
+
+// StreamInfo is what serve mode prints or writes for other players to pick up
+type StreamInfo struct {
+	URL       string `json:"url"`
+	LocalURL  string `json:"local_url"`
+	Title     string `json:"title"`
+	MagnetURI string `json:"magnet_uri"`
+	FileIndex int    `json:"file_index"`
+}
+
+// ServeStream makes a local stream reachable on the LAN.
+// With track set, the history entry moves to the next episode once a player has read most of the file.
+func ServeStream(databaseFile string, watching Torrent, streamURL string, track bool) (*StreamServer, error) {
+	config := GetGlobalConfig()
+
+	file, ok := watching.CurrentFile()
+	if !ok {
+		return nil, fmt.Errorf("file %d is not in the torrent", watching.FileIndex)
+	}
+
+	listener, err := net.Listen("tcp", ":"+config.ServePort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on port %s: %w", config.ServePort, err)
+	}
+
+	host, err := lanIP()
+	if err != nil {
+		host = "127.0.0.1"
+	}
+	name := path.Base(file.Path)
+
+	server := &StreamServer{
+		URL:          fmt.Sprintf("http://%s:%s/%s", host, config.ServePort, url.PathEscape(name)),
+		LocalURL:     streamURL,
+		Title:        file.DisplayName,
+		MagnetURI:    watching.URI,
+		FileIndex:    file.ActualIndex,
+		DatabaseFile: databaseFile,
+		Files:        watching.Files,
+		track:        track,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		percentage := proxyStream(w, r, streamURL, videoMimeType(name), nil, &server.progress)
+		if server.track && percentage >= 0 {
+			server.trackProgress(percentage)
+		}
+	})
+	server.server = &http.Server{Handler: mux}
+	go server.server.Serve(listener)
+
+	currentStreamServer = server
+	return server, nil
+}
+
+// Info returns the details other players need to open the stream
+func (s *StreamServer) Info() StreamInfo {
+	return StreamInfo{
+		URL:       s.URL,
+		LocalURL:  s.LocalURL,
+		Title:     s.Title,
+		MagnetURI: s.MagnetURI,
+		FileIndex: s.FileIndex,
+	}
+}
+
+// WriteInfo writes the stream URL to a file, as JSON when asJSON is set
+func (s *StreamServer) WriteInfo(filePath string, asJSON bool) error {
+	data := []byte(s.URL + "\n")
+	if asJSON {
+		var err error
+		data, err = json.MarshalIndent(s.Info(), "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	}
+	return os.WriteFile(filePath, data, 0644)
+}
+
+func (s *StreamServer) trackProgress(percentage float64) {
+	Debug("Player read %.1f%% of %s", percentage, s.Title)
+
+	config := GetGlobalConfig()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.completed || percentage < float64(config.PercentageToMarkCompleted) {
+		return
+	}
+	s.completed = true
+
+	if err := LocalUpdateEpisode(s.DatabaseFile, s.MagnetURI, s.FileIndex, 0, 0, true); err != nil {
+		Debug("Error updating episode history after serving %s: %v", s.Title, err)
+	}
+	if next, ok := NextEpisode(s.Files, s.FileIndex); ok {
+		if err := LocalUpdateTorrent(s.DatabaseFile, s.MagnetURI, next.ActualIndex, 0, next.DisplayName); err != nil {
+			Debug("Error updating database after serving %s: %v", s.Title, err)
+		}
+	}
+}
+
+// StopStreamServer stops serving the stream to other machines
+func StopStreamServer() {
+	if currentStreamServer == nil {
+		return
+	}
+	currentStreamServer.server.Close()
+	currentStreamServer = nil
+}
+
+// proxyStream forwards a (range) request to a local stream, adds what was sent to progress
+// and returns the percentage read so far, or -1 when the size is unknown
+func proxyStream(w http.ResponseWriter, r *http.Request, streamURL string, contentType string, extraHeaders map[string]string, progress *streamProgress) float64 {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, streamURL, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return -1
+	}
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return -1
+	}
+	defer resp.Body.Close()
+
+	for _, header := range []string{"Content-Length", "Content-Range", "Accept-Ranges"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	for key, value := range extraHeaders {
+		w.Header().Set(key, value)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	start, total := parseContentRange(resp)
+	copied, _ := io.Copy(w, resp.Body)
+	if total <= 0 || progress == nil {
+		return -1
+	}
+	return progress.add(start, start+copied, total)
+}
+
+// parseContentRange returns the first byte and total size of a (partial) response
+func parseContentRange(resp *http.Response) (int64, int64) {
+	var start, end, total int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err == nil {
+		return start, total
+	}
+	return 0, resp.ContentLength
+}
+
+// NextEpisode returns the file that follows fileIndex in season/episode order
+func NextEpisode(files []TorrentFileInfo, fileIndex int) (TorrentFileInfo, bool) {
+	return adjacentEpisode(files, fileIndex, 1)
+}
+
+// PreviousEpisode returns the file that comes before fileIndex in season/episode order
+func PreviousEpisode(files []TorrentFileInfo, fileIndex int) (TorrentFileInfo, bool) {
+	return adjacentEpisode(files, fileIndex, -1)
+}
+
+func adjacentEpisode(files []TorrentFileInfo, fileIndex int, offset int) (TorrentFileInfo, bool) {
+	episodes := SortedEpisodes(files)
+	for i, file := range episodes {
+		if file.ActualIndex == fileIndex && i+offset >= 0 && i+offset < len(episodes) {
+			return episodes[i+offset], true
+		}
+	}
+	return TorrentFileInfo{}, false
+}
@@ -1,5 +1,7 @@
 package internal
 
+import "path"
+
 // Create these in a new file like models.go or types.go
 
 type JackettResponse struct {
@@ -38,6 +40,24 @@ type Indexer struct {
 type TorrentFileInfo struct {
     DisplayName string
     ActualIndex int
+    Path        string
+    Subtitles   []ExternalTrack
+    AudioTracks []ExternalTrack
+    Archive     *RarArchive
+}
+
+// FileName returns the name of the file without the folders it is in, which is what release names are parsed from
+func (f TorrentFileInfo) FileName() string {
+    return path.Base(f.Path)
+}
+
+// ExternalTrack is a sidecar file (e.g. a subtitle or dub) shipped next to a video in the torrent
+type ExternalTrack struct {
+    Path     string
+    Index    int
+    URL      string
+    Language string
+    Title    string
 }
 
 type Torrent struct {
@@ -51,17 +71,34 @@ type Torrent struct {
     SortedFiles []string
 }
 
+// CurrentFile returns the video file that matches FileIndex
+func (t *Torrent) CurrentFile() (TorrentFileInfo, bool) {
+    // A show reset in the history starts over at its first episode
+    if t.FileIndex == NotStartedFileIndex {
+        if episodes := SortedEpisodes(t.Files); len(episodes) > 0 {
+            return episodes[0], true
+        }
+    }
+    for _, file := range t.Files {
+        if file.ActualIndex == t.FileIndex {
+            return file, true
+        }
+    }
+    return TorrentFileInfo{}, false
+}
+
 type User struct {
 	Watching   Torrent
-	Player     Player
+	Playback   PlaybackState
 	Resume     bool
 }
 
-type Player struct {
-	SocketPath string
+// PlaybackState is what buttercup knows about the episode the player is showing
+type PlaybackState struct {
 	PlaybackTime int
 	Started      bool
 	Duration int
 	Speed float64
+	Paused bool
 }
 
@@ -23,6 +23,9 @@ import (
 
 var currentWebtorrentProcess *os.Process
 
+// currentStreamURL is the stream most recently started by StartStream
+var currentStreamURL string
+
 type TorrentFile struct {
 	Path     string
 	Size     int64
@@ -194,6 +197,8 @@ func GetTorrentFiles(magnetURI string) ([]TorrentFileInfo, error) {
 
 	// Create list of video files with their actual indices
 	files := make([]TorrentFileInfo, 0)
+	subtitles := make([]ExternalTrack, 0)
+	audioTracks := make([]ExternalTrack, 0)
 	for i, file := range t.Files() {
 		if IsVideoFile(file.Path()) {
 			files = append(files, TorrentFileInfo{
@@ -201,17 +206,65 @@ func GetTorrentFiles(magnetURI string) ([]TorrentFileInfo, error) {
 					file.Path(),
 					humanize.Bytes(uint64(file.Length()))),
 				ActualIndex: i,
+				Path:        file.Path(),
+			})
+		} else if IsSubtitleFile(file.Path()) {
+			subtitles = append(subtitles, ExternalTrack{
+				Path:     file.Path(),
+				Index:    i,
+				URL:      webtorrentFileURL(t.InfoHash().HexString(), file.Path()),
+				Language: DetectLanguage(file.Path()),
+			})
+		} else if IsAudioFile(file.Path()) {
+			audioTracks = append(audioTracks, ExternalTrack{
+				Path:     file.Path(),
+				Index:    i,
+				URL:      webtorrentFileURL(t.InfoHash().HexString(), file.Path()),
+				Language: DetectLanguage(file.Path()),
 			})
 		}
 	}
 
+	// Videos stored inside RAR volumes are listed like regular files
+	files = append(files, findRarArchives(t)...)
+
 	if len(files) == 0 {
 		return nil, fmt.Errorf("no video files found in torrent")
 	}
 
+	// Attach subtitle and audio files to the episodes they belong to
+	for i := range files {
+		for _, subtitle := range subtitles {
+			if matchesVideo(files[i].Path, subtitle.Path, len(files) == 1) {
+				subtitle.Title = externalTrackTitle(files[i].Path, subtitle.Path)
+				files[i].Subtitles = append(files[i].Subtitles, subtitle)
+			}
+		}
+		for _, audio := range audioTracks {
+			if matchesVideo(files[i].Path, audio.Path, len(files) == 1) {
+				audio.Title = externalTrackTitle(files[i].Path, audio.Path)
+				files[i].AudioTracks = append(files[i].AudioTracks, audio)
+			}
+		}
+	}
+
 	return files, nil
 }
 
+// webtorrentFileURL builds the URL the webtorrent server streams a torrent file from
+func webtorrentFileURL(infoHash string, filePath string) string {
+	// Split the path and encode each component separately
+	pathComponents := strings.Split(filePath, "/")
+	encodedComponents := make([]string, len(pathComponents))
+	for i, component := range pathComponents {
+		encodedComponents[i] = url.PathEscape(component)
+	}
+
+	return fmt.Sprintf("http://localhost:8000/webtorrent/%s/%s",
+		infoHash,
+		strings.Join(encodedComponents, "/"))
+}
+
 func GetWebtorrentStreamURL(magnetURI string, selectedIndex int) (string, error) {
 	// Create temporary directory for downloads
 	tmpDir, err := os.MkdirTemp("", "torrent-stream-*")
@@ -244,19 +297,8 @@ func GetWebtorrentStreamURL(magnetURI string, selectedIndex int) (string, error)
 	// Get the selected file
 	selectedFile := t.Files()[selectedIndex]
 
-	// Split the path and encode each component separately
-	pathComponents := strings.Split(selectedFile.Path(), "/")
-	encodedComponents := make([]string, len(pathComponents))
-	for i, component := range pathComponents {
-		encodedComponents[i] = url.PathEscape(component)
-	}
-
 	// Construct the webtorrent URL with properly encoded path components
-	streamURL := fmt.Sprintf("http://localhost:8000/webtorrent/%x/%s",
-		t.InfoHash(),
-		strings.Join(encodedComponents, "/"))
-
-	return streamURL, nil
+	return webtorrentFileURL(t.InfoHash().HexString(), selectedFile.Path()), nil
 }
 
 // Add this helper function to check if a port is in use
@@ -270,47 +312,64 @@ func isPortInUse(port int) bool {
 	return false
 }
 
-func StreamTorrentWebtorrent(magnetURI string, selectedIndex int) (string, error) {
+// StartStream starts the webtorrent server for a file and returns its HTTP stream URL
+func StartStream(magnetURI string, file TorrentFileInfo) (string, error) {
+	streamURL, err := startStream(magnetURI, file)
+	if err != nil {
+		return "", err
+	}
+
+	publishNowPlaying(file.DisplayName, streamURL)
+	currentStreamURL = streamURL
+	return streamURL, nil
+}
+
+// CurrentStreamURL returns the local URL of the file being streamed
+func CurrentStreamURL() string {
+	return currentStreamURL
+}
+
+func startStream(magnetURI string, file TorrentFileInfo) (string, error) {
 	// Start webtorrent server
-	err := StartWebtorrentServer(magnetURI, selectedIndex)
+	err := StartWebtorrentServer(magnetURI, file.ActualIndex)
 	if err != nil {
 		return "", err
 	}
 
-	// Get the stream URL
-	streamURL, err := GetWebtorrentStreamURL(magnetURI, selectedIndex)
+	// Get the stream URL, videos inside RAR volumes are served by buttercup itself
+	var streamURL string
+	if file.Archive != nil {
+		streamURL, err = ServeRarArchive(file.Archive)
+	} else {
+		streamURL, err = GetWebtorrentStreamURL(magnetURI, file.ActualIndex)
+	}
 	if err != nil {
 		return "", err
 	}
 
 	Debug("Stream URL: %s", streamURL)
+	return streamURL, nil
+}
 
-	// Create socket path with random component
-	socketPath := filepath.Join("/tmp", fmt.Sprintf("buttercup-%x.sock", time.Now().UnixNano()))
-
-	// Start MPV once server is ready
-	mpvCmd := exec.Command("mpv",
-		"--force-seekable=yes",
-		"--input-ipc-server="+socketPath,
-		"--cache=yes",
-		"--cache-secs=10",
-		"--demuxer-max-bytes=50M",
-		"--demuxer-readahead-secs=5",
-		"--really-quiet",
-		streamURL,
-	)
-
-	// Redirect output to /dev/null
-	mpvCmd.Stdout = nil
-	mpvCmd.Stderr = nil
-
-	err = mpvCmd.Start()
+// StreamTorrentWebtorrent starts streaming a file and opens it in the configured player
+func StreamTorrentWebtorrent(magnetURI string, file TorrentFileInfo) (Player, error) {
+	streamURL, err := StartStream(magnetURI, file)
 	if err != nil {
-		return "", fmt.Errorf("failed to start mpv: %w", err)
+		return nil, err
 	}
+	return PlayStream(streamURL, file.DisplayName)
+}
 
-	Debug("Started mpv successfully")
-	return socketPath, nil
+// PlayStream opens a stream URL in the configured player
+func PlayStream(streamURL string, title string) (Player, error) {
+	player, err := NewPlayer(GetGlobalConfig())
+	if err != nil {
+		return nil, err
+	}
+	if err := player.Start(streamURL, title); err != nil {
+		return nil, err
+	}
+	return player, nil
 }
 
 func StreamTorrentSequentially(magnetURI string) error {
@@ -379,7 +438,8 @@ func StreamTorrentSequentially(magnetURI string) error {
 		return fmt.Errorf("failed to create named pipe: %w", err)
 	}
 
-	mpvPath, err := exec.LookPath("mpv")
+	config := GetGlobalConfig()
+	mpvPath, err := exec.LookPath(config.MpvPath)
 	if err != nil {
 		return fmt.Errorf("mpv not found: %w", err)
 	}
@@ -388,14 +448,11 @@ func StreamTorrentSequentially(magnetURI string) error {
 	socketPath := filepath.Join(tmpDir, "mpvsocket")
 
 	// Start MPV with socket
-	cmd := exec.Command(mpvPath,
-		"--force-seekable=yes",
-		"--input-ipc-server="+socketPath,
-		"--cache=yes",                // Enable cache
-		"--cache-secs=10",            // Cache 10 seconds
-		"--demuxer-max-bytes=50M",    // Allow larger forward cache
-		"--demuxer-readahead-secs=5", // Read 5 seconds ahead
-		pipePath)
+	mpvArgs, err := MpvArgs(config, socketPath)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(mpvPath, append(mpvArgs, pipePath)...)
 
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -488,6 +545,86 @@ func StreamTorrentSequentially(magnetURI string) error {
 	return cmd.Wait()
 }
 
+// Regular expression to match common episode patterns
+// Matches: s01e01, s1e1, 1x01, etc. but not resolutions like 1920x1080
+var seasonEpRegex = regexp.MustCompile(`(?i)s(\d{1,2})e(\d{1,2})|(?:^|\D)(\d{1,2})x(\d{1,2})(?:\D|$)`)
+
+// ParseEpisodeNumber extracts the season and episode numbers from a file name
+func ParseEpisodeNumber(name string) (int, int, bool) {
+	matches := seasonEpRegex.FindStringSubmatch(strings.ToLower(name))
+	if matches == nil {
+		return 0, 0, false
+	}
+
+	var season, episode int
+	if matches[1] != "" {
+		// s01e01 format
+		season, _ = strconv.Atoi(matches[1])
+		episode, _ = strconv.Atoi(matches[2])
+	} else {
+		// 1x01 format
+		season, _ = strconv.Atoi(matches[3])
+		episode, _ = strconv.Atoi(matches[4])
+	}
+	return season, episode, true
+}
+
+// absoluteEpisodeRegex matches the episode of releases numbered without a season, e.g. "Frieren - 05"
+var absoluteEpisodeRegex = regexp.MustCompile(`\s-\s(\d{1,4})\b`)
+
+// EpisodeNumber extracts the episode number from a file name, numbered by season or not
+func EpisodeNumber(name string) (int, bool) {
+	if _, episode, ok := ParseEpisodeNumber(name); ok {
+		return episode, true
+	}
+	if matches := absoluteEpisodeRegex.FindStringSubmatch(name); matches != nil {
+		episode, err := strconv.Atoi(matches[1])
+		return episode, err == nil
+	}
+	return 0, false
+}
+
+// Release name parsing, used to look up shows on AniList and Trakt
+var (
+	releaseTagRegex     = regexp.MustCompile(`\[[^\]]*\]|\([^)]*\)|\{[^}]*\}`)
+	episodeMarkRegex    = regexp.MustCompile(`(?i)(\bs\d{1,2}e\d{1,3}|\b\d{1,2}x\d{1,3}\b|\s-\s\d{1,4}\b|\b(ep|episode)\s*\d+|\b(480|720|1080|2160)p\b).*$`)
+	videoExtensionRegex = regexp.MustCompile(`(?i)\.(mkv|mp4|avi|webm|m4v|mov)$`)
+	releaseYearRegex    = regexp.MustCompile(`\b(19|20)\d{2}\b`)
+	// The size and RAR mark added to a file's path to display it, e.g. " (1.2 GB) [RAR]"
+	displaySizeRegex = regexp.MustCompile(`\s\(\d+(\.\d+)?\s[KkMGTPE]?B\)(\s\[RAR\])?$`)
+)
+
+// displayFileName returns the name of the file shown by a display name like "Folder/Show - 05.mkv (1.2 GB)",
+// which is what the watch history keeps
+func displayFileName(displayName string) string {
+	return filepath.Base(displaySizeRegex.ReplaceAllString(displayName, ""))
+}
+
+// ReleaseTitle turns a release or file name into the title of what it contains,
+// e.g. "[SubsPlease] Sousou no Frieren - 05 (1080p) [ABCD].mkv" becomes "Sousou no Frieren"
+func ReleaseTitle(name string) string {
+	name = videoExtensionRegex.ReplaceAllString(name, "")
+	name = releaseTagRegex.ReplaceAllString(name, " ")
+	name = strings.NewReplacer(".", " ", "_", " ").Replace(name)
+	name = episodeMarkRegex.ReplaceAllString(name, "")
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// ReleaseYear finds the year in a release name and returns the title without it,
+// e.g. "Blade.Runner.2049.2017.1080p.mkv" gives "Blade Runner 2049" and 2017
+func ReleaseYear(name string) (string, int) {
+	years := releaseYearRegex.FindAllString(videoExtensionRegex.ReplaceAllString(name, ""), -1)
+	title := ReleaseTitle(name)
+	if len(years) == 0 {
+		return title, 0
+	}
+	year, _ := strconv.Atoi(years[len(years)-1])
+	if i := strings.LastIndex(title, years[len(years)-1]); i > 0 {
+		title = strings.TrimSpace(title[:i])
+	}
+	return title, year
+}
+
 func FindAndSortEpisodes(files []string) []string {
 	type Episode struct {
 		Path    string
@@ -497,23 +634,9 @@ func FindAndSortEpisodes(files []string) []string {
 
 	var episodes []Episode
 
-	// Regular expression to match common episode patterns
-	// Matches: s01e01, s1e1, 1x01, etc.
-	seasonEpRegex := regexp.MustCompile(`(?i)s(\d{1,2})e(\d{1,2})|(\d{1,2})x(\d{1,2})`)
-
 	for _, file := range files {
-		matches := seasonEpRegex.FindStringSubmatch(strings.ToLower(file))
-		if matches != nil {
-			var season, episode int
-			if matches[1] != "" {
-				// s01e01 format
-				season, _ = strconv.Atoi(matches[1])
-				episode, _ = strconv.Atoi(matches[2])
-			} else {
-				// 1x01 format
-				season, _ = strconv.Atoi(matches[3])
-				episode, _ = strconv.Atoi(matches[4])
-			}
+		season, episode, ok := ParseEpisodeNumber(file)
+		if ok {
 			episodes = append(episodes, Episode{
 				Path:    file,
 				Season:  season,
@@ -554,6 +677,15 @@ func CleanupWebtorrent() {
 		currentWebtorrentProcess = nil
 	}
 
+	// Stop serving the previous RAR stream
+	if currentRarServer != nil {
+		currentRarServer.Close()
+		currentRarServer = nil
+	}
+
+	// A renderer asking for the file again has to start a new stream
+	forgetDlnaStream()
+
 	// Give it a moment to clean up
 	time.Sleep(500 * time.Millisecond)
 }
@@ -0,0 +1,81 @@
+package internal
+
+import "testing"
+
+func TestParseEpisodeNumber(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		season  int
+		episode int
+		ok      bool
+	}{
+		{"The.Expanse.S02E05.1080p.mkv", 2, 5, true},
+		{"show.s1e3.mkv", 1, 3, true},
+		{"Show_Name_1x03_720p.mp4", 1, 3, true},
+		{"Show 2x10.mkv", 2, 10, true},
+		{"Show - 05 [1920x1080].mkv", 0, 0, false},
+		{"Show.S01E05.[1920x1080].mkv", 1, 5, true},
+		{"Show - 05 (1280x720).mkv", 0, 0, false},
+	} {
+		season, episode, ok := ParseEpisodeNumber(test.name)
+		if season != test.season || episode != test.episode || ok != test.ok {
+			t.Errorf("ParseEpisodeNumber(%q) = %d, %d, %v, want %d, %d, %v", test.name, season, episode, ok, test.season, test.episode, test.ok)
+		}
+	}
+}
+
+func TestReleaseTitle(t *testing.T) {
+	for name, want := range map[string]string{
+		"[SubsPlease] Sousou no Frieren - 05 (1080p) [ABCD1234].mkv": "Sousou no Frieren",
+		"The.Expanse.S02E05.1080p.WEB-DL.mkv":                        "The Expanse",
+		"Show_Name_1x03_720p.mp4":                                    "Show Name",
+		"[Group] Some Anime Episode 12 [1080p]":                      "Some Anime",
+		"Inception (2010) [1080p].mkv":                               "Inception",
+	} {
+		if got := ReleaseTitle(name); got != want {
+			t.Errorf("ReleaseTitle(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestDisplayFileName(t *testing.T) {
+	for _, test := range []struct {
+		displayName string
+		fileName    string
+		title       string
+	}{
+		{"[Group] Frieren - 01-28 (Batch) [1080p]/[Group] Frieren - 05 [1920x1080].mkv (1.4 GB)",
+			"[Group] Frieren - 05 [1920x1080].mkv", "Frieren"},
+		{"The.Expanse.S02/The.Expanse.S02E05.1080p.mkv (1.2 GB)", "The.Expanse.S02E05.1080p.mkv", "The Expanse"},
+		{"Show/Show.S01E01.mkv (700.00 MB) [RAR]", "Show.S01E01.mkv", "Show"},
+		{"Inception (2010) [1080p].mkv (4 GB)", "Inception (2010) [1080p].mkv", "Inception"},
+		// Titles of the old history have no size
+		{"Movie (2019)", "Movie (2019)", "Movie"},
+	} {
+		fileName := displayFileName(test.displayName)
+		if fileName != test.fileName {
+			t.Errorf("displayFileName(%q) = %q, want %q", test.displayName, fileName, test.fileName)
+		}
+		if title := ReleaseTitle(fileName); title != test.title {
+			t.Errorf("ReleaseTitle(%q) = %q, want %q", fileName, title, test.title)
+		}
+	}
+}
+
+func TestReleaseYear(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		title string
+		year  int
+	}{
+		{"The.Expanse.2015.S02E05.1080p.mkv", "The Expanse", 2015},
+		{"Blade.Runner.2049.2017.1080p.BluRay.mkv", "Blade Runner 2049", 2017},
+		{"Inception (2010) [1080p].mkv", "Inception", 2010},
+		{"[SubsPlease] Sousou no Frieren - 05 (1080p).mkv", "Sousou no Frieren", 0},
+	} {
+		title, year := ReleaseYear(test.name)
+		if title != test.title || year != test.year {
+			t.Errorf("ReleaseYear(%q) = %q, %d, want %q, %d", test.name, title, year, test.title, test.year)
+		}
+	}
+}
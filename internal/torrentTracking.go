@@ -4,94 +4,114 @@ import (
 	"encoding/csv"
 	"fmt"
 	"os"
-	"path/filepath"
 	"strconv"
+	"time"
 )
 
 // TorrentData represents the structure for storing torrent playback information
 type TorrentData struct {
-	MagnetURI    string
-	FileName     string
-	FileIndex    int
-	PlaybackTime int
-	Title        string
+	MagnetURI     string
+	FileName      string
+	FileIndex     int
+	PlaybackTime  int
+	Title         string
+	ShowTitle     string // Name the user gave the show, empty to go by the episode title
+	Finished      bool   // Hidden from Continue Watching
+	AnilistID     int    // Linked AniList media, 0 when not linked yet and -1 when not on AniList
+	ChapterSkip   string // Per-show chapter skip mode, empty to use the config
+	Intro         SkipSegment
+	Outro         SkipSegment // Relative to the end of the episode, so both times are negative
+	EpisodeCount  int
+	AudioTrack    TrackChoice
+	SubtitleTrack TrackChoice
+	UpdatedAt     time.Time
 }
 
-// Function to add a torrent entry
-func LocalAddTorrent(databaseFile string, magnetURI string, fileIndex int, playbackTime int, title string) {
-	// Read existing entries first
-	torrentList := LocalGetAllTorrents(databaseFile)
-
-	// Check if magnet URI already exists
-	for _, torrent := range torrentList {
-		if torrent.MagnetURI == magnetURI {
-			// Update existing entry instead of creating new one
-			err := LocalUpdateTorrent(databaseFile, magnetURI, fileIndex, playbackTime, title)
-			if err != nil {
-				Output(fmt.Sprintf("Error updating existing torrent: %v", err))
-			}
-			return
-		}
+// DisplayTitle is the name to show for the entry in menus
+func (t TorrentData) DisplayTitle() string {
+	if t.ShowTitle != "" {
+		return t.ShowTitle
 	}
+	return t.Title
+}
 
-	// If we get here, it's a new magnet URI
-	file, err := os.OpenFile(databaseFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		Output(fmt.Sprintf("Error opening file: %v", err))
-		return
+// Function to add a torrent entry
+func LocalAddTorrent(databaseFile string, magnetURI string, fileIndex int, playbackTime int, title string) {
+	if err := LocalUpdateTorrent(databaseFile, magnetURI, fileIndex, playbackTime, title); err != nil {
+		Output(fmt.Sprintf("Error adding torrent: %v", err))
 	}
-	defer file.Close()
+}
 
-	writer := csv.NewWriter(file)
-	writer.Comma = '|'
-	defer writer.Flush()
+// Function to get all torrent entries
+func LocalGetAllTorrents(databaseFile string) []TorrentData {
+	return queryTorrents(databaseFile, "")
+}
 
-	err = writer.Write([]string{
-		magnetURI,
-		strconv.Itoa(fileIndex),
-		strconv.Itoa(playbackTime),
-		title,
-	})
-	if err != nil {
-		Output(fmt.Sprintf("Error writing to file: %v", err))
-	} else {
-		Output("Written to file")
+// LocalGetTorrent returns the history entry of a torrent, nil when it isn't in the history
+func LocalGetTorrent(databaseFile string, magnetURI string) *TorrentData {
+	torrents := queryTorrents(databaseFile, "WHERE t.magnet_uri = ?", magnetURI)
+	if len(torrents) == 0 {
+		return nil
 	}
+	return &torrents[0]
 }
 
-// Function to get all torrent entries
-func LocalGetAllTorrents(databaseFile string) []TorrentData {
+func queryTorrents(databaseFile string, where string, args ...interface{}) []TorrentData {
 	torrentList := []TorrentData{}
 
-	// Ensure the directory exists
-	dir := filepath.Dir(databaseFile)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		Output(fmt.Sprintf("Error creating directory: %v", err))
+	db, err := openWatchDatabase(databaseFile)
+	if err != nil {
+		Output(fmt.Sprintf("Error opening watch database: %v", err))
 		return torrentList
 	}
 
-	// Open the file, create if it doesn't exist
-	file, err := os.OpenFile(databaseFile, os.O_RDONLY|os.O_CREATE, 0644)
+	rows, err := db.Query(`SELECT t.magnet_uri, t.file_name, t.file_index, t.playback_time, t.title, t.episode_count, t.updated_at,
+		s.title, s.finished, s.anilist_id, s.chapter_skip, s.intro_start, s.intro_end, s.outro_start, s.outro_end,
+		s.audio_language, s.audio_title, s.subtitle_language, s.subtitle_title, s.subtitles_off
+		FROM torrents t JOIN shows s ON s.id = t.show_id `+where+` ORDER BY t.rowid`, args...)
 	if err != nil {
-		Output(fmt.Sprintf("Error opening or creating file: %v", err))
+		Output(fmt.Sprintf("Error reading watch database: %v", err))
 		return torrentList
 	}
-	defer file.Close()
+	defer rows.Close()
+
+	for rows.Next() {
+		var t TorrentData
+		var updatedAt int64
+		err := rows.Scan(&t.MagnetURI, &t.FileName, &t.FileIndex, &t.PlaybackTime, &t.Title, &t.EpisodeCount, &updatedAt,
+			&t.ShowTitle, &t.Finished, &t.AnilistID, &t.ChapterSkip, &t.Intro.Start, &t.Intro.End, &t.Outro.Start, &t.Outro.End,
+			&t.AudioTrack.Language, &t.AudioTrack.Title,
+			&t.SubtitleTrack.Language, &t.SubtitleTrack.Title, &t.SubtitleTrack.Off)
+		if err != nil {
+			Output(fmt.Sprintf("Error reading watch database: %v", err))
+			return torrentList
+		}
+		t.UpdatedAt = time.Unix(updatedAt, 0)
+		torrentList = append(torrentList, t)
+	}
+	if err := rows.Err(); err != nil {
+		Output(fmt.Sprintf("Error reading watch database: %v", err))
+	}
+	return torrentList
+}
+
+// readLegacyTorrents reads the pipe separated torrent_history.txt used before the watch database
+func readLegacyTorrents(historyFile string) []TorrentData {
+	torrentList := []TorrentData{}
 
-	// If the file was just created, return empty list
-	fileInfo, err := file.Stat()
+	file, err := os.Open(historyFile)
 	if err != nil {
-		Output(fmt.Sprintf("Error getting file info: %v", err))
-		return torrentList
-	}
-	if fileInfo.Size() == 0 {
+		if !os.IsNotExist(err) {
+			Output(fmt.Sprintf("Error opening file: %v", err))
+		}
 		return torrentList
 	}
+	defer file.Close()
 
 	reader := csv.NewReader(file)
 	reader.Comma = '|'
 	reader.FieldsPerRecord = 4
-	
+
 	records, err := reader.ReadAll()
 	if err != nil {
 		Output(fmt.Sprintf("Error reading file: %v", err))
@@ -120,6 +140,7 @@ func parseTorrentRow(row []string) *TorrentData {
 
 	return &TorrentData{
 		MagnetURI:    row[0],
+		FileName:     row[3], // The file name was never written, the title is the name of the file
 		FileIndex:    fileIndex,
 		PlaybackTime: playbackTime,
 		Title:        row[3],
@@ -128,56 +149,52 @@ func parseTorrentRow(row []string) *TorrentData {
 
 // Function to update or add a torrent entry
 func LocalUpdateTorrent(databaseFile string, magnetURI string, fileIndex int, playbackTime int, title string) error {
-	// Read existing entries
-	torrentList := LocalGetAllTorrents(databaseFile)
+	return LocalUpdateTorrentEntry(databaseFile, magnetURI, func(torrent *TorrentData) {
+		torrent.FileIndex = fileIndex
+		torrent.PlaybackTime = playbackTime
+		torrent.FileName = title
+		torrent.Title = title
+	})
+}
 
-	// Find and update existing entry or add new one
-	updated := false
-	for i, torrent := range torrentList {
-		if torrent.MagnetURI == magnetURI {
-			torrentList[i].FileIndex = fileIndex
-			torrentList[i].PlaybackTime = playbackTime
-			torrentList[i].Title = title
-			updated = true
-			break
-		}
+// LocalUpdateTorrentSettings changes the per-show settings of an existing entry
+func LocalUpdateTorrentSettings(databaseFile string, magnetURI string, update func(*TorrentData)) error {
+	if LocalGetTorrent(databaseFile, magnetURI) == nil {
+		return fmt.Errorf("torrent is not in the history")
 	}
+	return LocalUpdateTorrentEntry(databaseFile, magnetURI, update)
+}
 
-	if !updated {
-		newTorrent := TorrentData{
-			MagnetURI:    magnetURI,
-			FileIndex:    fileIndex,
-			PlaybackTime: playbackTime,
-			Title:        title,
-		}
-		torrentList = append(torrentList, newTorrent)
+// LocalUpdateTorrentEntry changes an entry in one transaction, adding it when it's new
+func LocalUpdateTorrentEntry(databaseFile string, magnetURI string, update func(*TorrentData)) error {
+	db, err := openWatchDatabase(databaseFile)
+	if err != nil {
+		return err
 	}
 
-	// Write updated list back to file
-	file, err := os.Create(databaseFile)
+	// Other instances could change the entry between reading and writing it
+	unlock, err := LockFile(databaseFile)
 	if err != nil {
-		return fmt.Errorf("error creating file: %v", err)
+		return err
 	}
-	defer file.Close()
+	defer unlock()
 
-	writer := csv.NewWriter(file)
-	writer.Comma = '|'
-	defer writer.Flush()
+	torrent := TorrentData{MagnetURI: magnetURI}
+	if existing := LocalGetTorrent(databaseFile, magnetURI); existing != nil {
+		torrent = *existing
+	}
+	update(&torrent)
+	torrent.UpdatedAt = time.Now()
 
-	for _, torrent := range torrentList {
-		record := []string{
-			torrent.MagnetURI,
-			strconv.Itoa(torrent.FileIndex),
-			strconv.Itoa(torrent.PlaybackTime),
-			torrent.Title,
-		}
-		if err := writer.Write(record); err != nil {
-			return fmt.Errorf("error writing record: %v", err)
-		}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
-	
-	writer.Flush()
-	return nil
+	defer tx.Rollback()
+	if err := saveTorrent(tx, torrent); err != nil {
+		return fmt.Errorf("error saving torrent: %w", err)
+	}
+	return tx.Commit()
 }
 
 // Function to find a torrent by magnet URI and file index
@@ -188,4 +205,14 @@ func LocalFindTorrent(torrentList []TorrentData, magnetURI string, fileIndex int
 		}
 	}
 	return nil
-} 
\ No newline at end of file
+} 
+
+// LocalFindTorrentByURI finds the history entry of a torrent regardless of the file being watched
+func LocalFindTorrentByURI(torrentList []TorrentData, magnetURI string) *TorrentData {
+	for _, torrent := range torrentList {
+		if torrent.MagnetURI == magnetURI {
+			return &torrent
+		}
+	}
+	return nil
+}
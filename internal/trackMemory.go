@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TrackChoice is an audio or subtitle track picked for a show, stored by language and title
+// because track numbers differ between episodes
+type TrackChoice struct {
+	Language string
+	Title    string
+	Off      bool // Subtitles turned off
+}
+
+// IsSet reports whether a choice has been made
+func (c TrackChoice) IsSet() bool {
+	return c.Language != "" || c.Title != "" || c.Off
+}
+
+// mpvTrack is an entry of mpv's track-list
+type mpvTrack struct {
+	ID       int
+	Type     string
+	Language string
+	Title    string
+	Selected bool
+	Forced   bool
+}
+
+// TrackMemory re-applies a show's audio and subtitle choices and saves new ones when the user switches tracks
+type TrackMemory struct {
+	client       *MPVClient
+	databaseFile string
+	magnetURI    string
+	current      map[string]interface{}
+}
+
+// NewTrackMemory selects the show's saved tracks in mpv. The player observes aid/sid, their changes go to HandleChange.
+func NewTrackMemory(client *MPVClient, databaseFile string, magnetURI string) (*TrackMemory, error) {
+	memory := &TrackMemory{
+		client:       client,
+		databaseFile: databaseFile,
+		magnetURI:    magnetURI,
+		current:      make(map[string]interface{}),
+	}
+
+	if torrent := LocalGetTorrent(databaseFile, magnetURI); torrent != nil {
+		tracks, err := mpvTracks(client)
+		if err != nil {
+			return nil, err
+		}
+		memory.apply("aid", "audio", torrent.AudioTrack, tracks)
+		memory.apply("sid", "sub", torrent.SubtitleTrack, tracks)
+	}
+
+	// Remember what is selected now so only later switches count as a choice
+	for _, property := range []string{"aid", "sid"} {
+		value, err := client.GetProperty(property)
+		if err != nil {
+			return nil, err
+		}
+		memory.current[property] = value
+	}
+	return memory, nil
+}
+
+// apply selects the track that best matches a saved choice
+func (m *TrackMemory) apply(property string, trackType string, choice TrackChoice, tracks []mpvTrack) {
+	if !choice.IsSet() {
+		return
+	}
+	if choice.Off {
+		Debug("Turning off %s as saved for this show", property)
+		m.client.SetProperty(property, "no")
+		return
+	}
+
+	best, bestScore := -1, 0
+	for _, track := range tracks {
+		if track.Type != trackType {
+			continue
+		}
+		score := 0
+		if choice.Language != "" && NormalizeLanguage(track.Language) == NormalizeLanguage(choice.Language) {
+			score += 2
+		} else if choice.Language != "" {
+			continue
+		}
+		if choice.Title != "" && strings.EqualFold(track.Title, choice.Title) {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = track.ID, score
+		}
+	}
+	if best < 0 {
+		Debug("No %s track matches %+v", trackType, choice)
+		return
+	}
+	Debug("Selecting %s track %d to match %+v", trackType, best, choice)
+	if err := m.client.SetProperty(property, best); err != nil {
+		Debug("Error selecting %s track: %v", trackType, err)
+	}
+}
+
+// HandleChange saves the selection when the user switches the audio or subtitle track
+func (m *TrackMemory) HandleChange(event PlayerEvent) {
+	if event.Property != "aid" && event.Property != "sid" {
+		return
+	}
+	if fmt.Sprint(event.Data) == fmt.Sprint(m.current[event.Property]) {
+		return
+	}
+	m.current[event.Property] = event.Data
+
+	tracks, err := mpvTracks(m.client)
+	if err != nil {
+		Debug("Error reading track list: %v", err)
+		return
+	}
+	trackType := "audio"
+	if event.Property == "sid" {
+		trackType = "sub"
+	}
+
+	choice := TrackChoice{Off: trackType == "sub"}
+	for _, track := range tracks {
+		if track.Type == trackType && track.Selected {
+			choice = TrackChoice{Language: track.Language, Title: track.Title}
+			break
+		}
+	}
+	if !choice.IsSet() {
+		return
+	}
+
+	Debug("Saving %s choice %+v", trackType, choice)
+	err = LocalUpdateTorrentSettings(m.databaseFile, m.magnetURI, func(torrent *TorrentData) {
+		if trackType == "sub" {
+			torrent.SubtitleTrack = choice
+		} else {
+			torrent.AudioTrack = choice
+		}
+	})
+	if err != nil {
+		Debug("Error saving track choice: %v", err)
+	}
+}
+
+// SelectForcedSubtitles shows only forced (signs and songs) subtitles, preferring the subtitle languages,
+// and turns subtitles off when there are none
+func SelectForcedSubtitles(client *MPVClient) error {
+	tracks, err := mpvTracks(client)
+	if err != nil {
+		return err
+	}
+
+	var forced []mpvTrack
+	for _, track := range tracks {
+		title := strings.ToLower(track.Title)
+		if track.Type == "sub" && (track.Forced || strings.Contains(title, "forced") || strings.Contains(title, "sign")) {
+			forced = append(forced, track)
+		}
+	}
+	if len(forced) == 0 {
+		return client.SetProperty("sid", "no")
+	}
+
+	best := forced[0]
+search:
+	for _, lang := range preferredLanguages(client, GetGlobalConfig().PreferredSubtitleLanguages, "slang") {
+		for _, track := range forced {
+			if NormalizeLanguage(track.Language) == lang {
+				best = track
+				break search
+			}
+		}
+	}
+	Debug("Selecting forced subtitle track %d (%s, %s)", best.ID, best.Language, best.Title)
+	return client.SetProperty("sid", best.ID)
+}
+
+// mpvTracks reads mpv's track-list
+func mpvTracks(client *MPVClient) ([]mpvTrack, error) {
+	value, err := client.GetProperty("track-list")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read track list: %w", err)
+	}
+	list, _ := value.([]interface{})
+
+	tracks := make([]mpvTrack, 0, len(list))
+	for _, item := range list {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id, _ := entry["id"].(float64)
+		track := mpvTrack{ID: int(id)}
+		track.Type, _ = entry["type"].(string)
+		track.Language, _ = entry["lang"].(string)
+		track.Title, _ = entry["title"].(string)
+		track.Selected, _ = entry["selected"].(bool)
+		track.Forced, _ = entry["forced"].(bool)
+		tracks = append(tracks, track)
+	}
+	return tracks, nil
+}
@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TraktToken is the OAuth token Trakt hands out, kept as Trakt sends it
+type TraktToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// Expired reports whether the token runs out within a day
+func (t TraktToken) Expired() bool {
+	return time.Now().Add(24 * time.Hour).After(time.Unix(t.CreatedAt+t.ExpiresIn, 0))
+}
+
+// TraktDeviceCode is what the user enters on the Trakt website to authorize buttercup
+type TraktDeviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURL string `json:"verification_url"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+// TraktClient talks to the Trakt API
+type TraktClient struct {
+	APIURL       string
+	ClientID     string
+	ClientSecret string
+	Token        TraktToken
+	client       *http.Client
+}
+
+// NewTraktClient creates a client for the API at apiURL with the app's credentials
+func NewTraktClient(apiURL string, clientID string, clientSecret string) *TraktClient {
+	return &TraktClient{
+		APIURL:       apiURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// post sends body as JSON and decodes the response into result, returning the status code
+func (c *TraktClient) post(path string, body interface{}, result interface{}) (int, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", c.APIURL+path, bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("trakt-api-version", "2")
+	req.Header.Set("trakt-api-key", c.ClientID)
+	if c.Token.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token.AccessToken)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reach Trakt: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, fmt.Errorf("failed to read Trakt response: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("bad response from Trakt: %d", resp.StatusCode)
+	}
+	if result != nil {
+		if err := json.Unmarshal(respBody, result); err != nil {
+			return resp.StatusCode, fmt.Errorf("failed to parse Trakt response: %w", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// DeviceCode starts the device authorization
+func (c *TraktClient) DeviceCode() (TraktDeviceCode, error) {
+	var code TraktDeviceCode
+	_, err := c.post("/oauth/device/code", map[string]string{"client_id": c.ClientID}, &code)
+	return code, err
+}
+
+// traktMinPollInterval keeps polling for the device token slow enough when Trakt sends no interval
+var traktMinPollInterval = 5 * time.Second
+
+// WaitDeviceToken polls until the user authorized the device code, or it expires
+func (c *TraktClient) WaitDeviceToken(code TraktDeviceCode) (TraktToken, error) {
+	interval := time.Duration(code.Interval) * time.Second
+	if interval < traktMinPollInterval {
+		interval = traktMinPollInterval
+	}
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	body := map[string]string{"code": code.DeviceCode, "client_id": c.ClientID, "client_secret": c.ClientSecret}
+
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		var token TraktToken
+		status, err := c.post("/oauth/device/token", body, &token)
+		switch status {
+		case http.StatusOK:
+			return token, err
+		case http.StatusBadRequest:
+			// Not authorized yet
+		case http.StatusTooManyRequests:
+			interval += time.Second
+		case http.StatusNotFound:
+			return token, fmt.Errorf("invalid device code")
+		case http.StatusConflict:
+			return token, fmt.Errorf("the code was already used")
+		case http.StatusGone:
+			return token, fmt.Errorf("the code expired")
+		case 418:
+			return token, fmt.Errorf("authorization was denied")
+		case 0:
+			// Trakt couldn't be reached, the code is still good until it expires
+			Debug("Error polling for the Trakt token: %v", err)
+		default:
+			if err != nil {
+				return token, err
+			}
+		}
+	}
+	return TraktToken{}, fmt.Errorf("the code expired")
+}
+
+// RefreshToken swaps an expiring token for a new one
+func (c *TraktClient) RefreshToken() (TraktToken, error) {
+	var token TraktToken
+	_, err := c.post("/oauth/token", map[string]string{
+		"refresh_token": c.Token.RefreshToken,
+		"client_id":     c.ClientID,
+		"client_secret": c.ClientSecret,
+		"redirect_uri":  "urn:ietf:wg:oauth:2.0:oob",
+		"grant_type":    "refresh_token",
+	}, &token)
+	return token, err
+}
+
+// Scrobble reports that playback started, paused or stopped, action being "start", "pause" or "stop".
+// A conflict means Trakt already has the item as just watched, which is not an error.
+func (c *TraktClient) Scrobble(action string, item TraktItem) error {
+	status, err := c.post("/scrobble/"+action, item, nil)
+	if status == http.StatusConflict {
+		return nil
+	}
+	if status == http.StatusNotFound {
+		return fmt.Errorf("%s was not found on Trakt", item.Name())
+	}
+	return err
+}
+
+// traktTokenFile keeps the Trakt token next to the watch database, readable only by the user
+func traktTokenFile() string {
+	return filepath.Join(os.ExpandEnv(GetGlobalConfig().StoragePath), "trakt_token.json")
+}
+
+// LoadTraktToken returns the stored Trakt token, false when the user hasn't logged in
+func LoadTraktToken() (TraktToken, bool) {
+	var token TraktToken
+	data, err := os.ReadFile(traktTokenFile())
+	if err != nil {
+		return token, false
+	}
+	if err := json.Unmarshal(data, &token); err != nil || token.AccessToken == "" {
+		return token, false
+	}
+	return token, true
+}
+
+// SaveTraktToken stores the Trakt token
+func SaveTraktToken(token TraktToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(traktTokenFile(), data, 0600)
+}
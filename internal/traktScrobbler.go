@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+const traktUsage = `Usage: buttercup trakt <command>
+
+  login    Authorize buttercup to scrobble to your Trakt account
+  logout   Forget the Trakt token`
+
+// TraktItem is the episode or movie being scrobbled, with how far into it playback is
+type TraktItem struct {
+	Show     *TraktShow    `json:"show,omitempty"`
+	Episode  *TraktEpisode `json:"episode,omitempty"`
+	Movie    *TraktMovie   `json:"movie,omitempty"`
+	Progress float64       `json:"progress"`
+}
+
+// TraktShow is matched by title and year, Trakt looks up the show itself
+type TraktShow struct {
+	Title string `json:"title"`
+	Year  int    `json:"year,omitempty"`
+}
+
+// TraktEpisode is an episode of the show by season and number
+type TraktEpisode struct {
+	Season int `json:"season"`
+	Number int `json:"number"`
+}
+
+// TraktMovie is matched by title and year
+type TraktMovie struct {
+	Title string `json:"title"`
+	Year  int    `json:"year,omitempty"`
+}
+
+// NewTraktItem maps a file to an episode when its season and episode can be parsed, and to a movie otherwise
+func NewTraktItem(file TorrentFileInfo) TraktItem {
+	title, year := ReleaseYear(file.FileName())
+	if season, episode, ok := ParseEpisodeNumber(file.FileName()); ok {
+		return TraktItem{
+			Show:    &TraktShow{Title: title, Year: year},
+			Episode: &TraktEpisode{Season: season, Number: episode},
+		}
+	}
+	return TraktItem{Movie: &TraktMovie{Title: title, Year: year}}
+}
+
+// Name describes the item for messages, e.g. "Show S01E03"
+func (i TraktItem) Name() string {
+	if i.Episode != nil {
+		return fmt.Sprintf("%s S%02dE%02d", i.Show.Title, i.Episode.Season, i.Episode.Number)
+	}
+	return i.Movie.Title
+}
+
+type traktEvent struct {
+	action string
+	item   TraktItem
+	done   chan struct{}
+}
+
+// TraktScrobbler reports playback to Trakt in the background, in the order it happened
+type TraktScrobbler struct {
+	client *TraktClient
+	events chan traktEvent
+	once   sync.Once
+}
+
+// NewTraktScrobbler returns nil when scrobbling is off or the user hasn't logged in
+func NewTraktScrobbler() *TraktScrobbler {
+	config := GetGlobalConfig()
+	if !config.TraktScrobble {
+		return nil
+	}
+	token, ok := LoadTraktToken()
+	if !ok {
+		Info("Trakt scrobbling is on but not logged in, run buttercup trakt login")
+		return nil
+	}
+
+	client := NewTraktClient(config.TraktApiUrl, config.TraktClientID, config.TraktClientSecret)
+	client.Token = token
+	s := &TraktScrobbler{client: client, events: make(chan traktEvent, 16)}
+	go s.run()
+	return s
+}
+
+func (s *TraktScrobbler) run() {
+	for event := range s.events {
+		s.refreshToken()
+		if err := s.client.Scrobble(event.action, event.item); err != nil {
+			Debug("Error scrobbling %s to Trakt: %v", event.action, err)
+		} else {
+			Debug("Scrobbled %s of %s to Trakt at %.1f%%", event.action, event.item.Name(), event.item.Progress)
+		}
+		if event.done != nil {
+			close(event.done)
+		}
+	}
+}
+
+// refreshToken renews the token before it expires, Trakt tokens last three months
+func (s *TraktScrobbler) refreshToken() {
+	if !s.client.Token.Expired() {
+		return
+	}
+	token, err := s.client.RefreshToken()
+	if err != nil {
+		Debug("Error refreshing Trakt token: %v", err)
+		return
+	}
+	s.client.Token = token
+	if err := SaveTraktToken(token); err != nil {
+		Debug("Error saving Trakt token: %v", err)
+	}
+}
+
+func (s *TraktScrobbler) send(action string, file TorrentFileInfo, progress float64, wait bool) {
+	if s == nil {
+		return
+	}
+	item := NewTraktItem(file)
+	item.Progress = progress
+	event := traktEvent{action: action, item: item}
+	if wait {
+		event.done = make(chan struct{})
+	}
+	select {
+	case s.events <- event:
+	default:
+		Debug("Trakt is not keeping up, dropping %s", action)
+		return
+	}
+	if wait {
+		<-event.done
+	}
+}
+
+// Start reports that the file started or resumed playing, progress being the percentage watched
+func (s *TraktScrobbler) Start(file TorrentFileInfo, progress float64) {
+	s.send("start", file, progress, false)
+}
+
+// Pause reports that playback of the file was paused
+func (s *TraktScrobbler) Pause(file TorrentFileInfo, progress float64) {
+	s.send("pause", file, progress, false)
+}
+
+// Stop reports that the file stopped playing and waits for it to be sent, so it isn't lost when buttercup exits.
+// Trakt counts the file as watched from 80% on.
+func (s *TraktScrobbler) Stop(file TorrentFileInfo, progress float64) {
+	s.send("stop", file, progress, true)
+}
+
+// RunTraktCommand runs a "buttercup trakt" subcommand
+func RunTraktCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing command\n%s", traktUsage)
+	}
+	config := GetGlobalConfig()
+
+	switch args[0] {
+	case "help":
+		fmt.Println(traktUsage)
+	case "login":
+		if config.TraktClientID == "" || config.TraktClientSecret == "" {
+			return fmt.Errorf("set TraktClientID and TraktClientSecret in the config to those of a Trakt app " +
+				"(create one at https://trakt.tv/oauth/applications with urn:ietf:wg:oauth:2.0:oob as the redirect URI)")
+		}
+		client := NewTraktClient(config.TraktApiUrl, config.TraktClientID, config.TraktClientSecret)
+		code, err := client.DeviceCode()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Go to %s and enter the code %s\n", code.VerificationURL, code.UserCode)
+		token, err := client.WaitDeviceToken(code)
+		if err != nil {
+			return err
+		}
+		if err := SaveTraktToken(token); err != nil {
+			return fmt.Errorf("failed to save Trakt token: %w", err)
+		}
+		fmt.Println("Logged in to Trakt")
+		if !config.TraktScrobble {
+			fmt.Println("Set TraktScrobble to true in the config to scrobble while watching")
+		}
+	case "logout":
+		if err := os.Remove(traktTokenFile()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		fmt.Println("Logged out of Trakt")
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], traktUsage)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTraktTokens answers the device token polls with the given statuses in turn,
+// status 0 dropping the connection
+func fakeTraktTokens(t *testing.T, statuses ...int) (*httptest.Server, *[]time.Time) {
+	t.Helper()
+	var mu sync.Mutex
+	var polls []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		polls = append(polls, time.Now())
+		status := http.StatusBadRequest
+		if len(polls) <= len(statuses) {
+			status = statuses[len(polls)-1]
+		}
+		mu.Unlock()
+
+		if r.URL.Path != "/oauth/device/token" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		switch status {
+		case 0:
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		case http.StatusOK:
+			w.Write([]byte(`{"access_token": "access", "refresh_token": "refresh", "expires_in": 7776000, "created_at": 1700000000}`))
+		default:
+			w.WriteHeader(status)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &polls
+}
+
+func fastTraktPolling(t *testing.T, interval time.Duration) {
+	t.Helper()
+	minInterval := traktMinPollInterval
+	traktMinPollInterval = interval
+	t.Cleanup(func() { traktMinPollInterval = minInterval })
+}
+
+func TestTraktWaitDeviceToken(t *testing.T) {
+	fastTraktPolling(t, 10*time.Millisecond)
+
+	// Pending, slow down and an unreachable Trakt keep polling until the user authorized buttercup
+	server, polls := fakeTraktTokens(t, http.StatusBadRequest, http.StatusTooManyRequests, 0, http.StatusOK)
+	client := NewTraktClient(server.URL, "id", "secret")
+	token, err := client.WaitDeviceToken(TraktDeviceCode{DeviceCode: "device", ExpiresIn: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "access" || token.RefreshToken != "refresh" {
+		t.Errorf("unexpected token %+v", token)
+	}
+	if len(*polls) != 4 {
+		t.Errorf("got %d polls, want 4", len(*polls))
+	}
+
+	for status, want := range map[int]string{http.StatusGone: "expired", 418: "denied"} {
+		server, polls := fakeTraktTokens(t, http.StatusBadRequest, status)
+		_, err := NewTraktClient(server.URL, "id", "secret").WaitDeviceToken(TraktDeviceCode{DeviceCode: "device", ExpiresIn: 30})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("status %d: got error %v, want it to say %q", status, err, want)
+		}
+		if len(*polls) != 2 {
+			t.Errorf("status %d: got %d polls, want 2", status, len(*polls))
+		}
+	}
+}
+
+func TestTraktWaitDeviceTokenMinimumInterval(t *testing.T) {
+	fastTraktPolling(t, 100*time.Millisecond)
+
+	server, polls := fakeTraktTokens(t, http.StatusBadRequest, http.StatusBadRequest, http.StatusOK)
+	started := time.Now()
+	_, err := NewTraktClient(server.URL, "id", "secret").WaitDeviceToken(TraktDeviceCode{DeviceCode: "device", Interval: 0, ExpiresIn: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := started
+	for i, poll := range *polls {
+		if gap := poll.Sub(previous); gap < traktMinPollInterval {
+			t.Errorf("poll %d came %v after the previous one with an interval of 0", i+1, gap)
+		}
+		previous = poll
+	}
+}
+
+func TestNewTraktItem(t *testing.T) {
+	for _, test := range []struct {
+		path string
+		want TraktItem
+	}{
+		{"The.Expanse.S02/The.Expanse.S02E05.1080p.mkv", TraktItem{
+			Show: &TraktShow{Title: "The Expanse"}, Episode: &TraktEpisode{Season: 2, Number: 5}}},
+		{"The.Expanse.2015.Complete/Season 2/The.Expanse.2015.S02E05.1080p.mkv", TraktItem{
+			Show: &TraktShow{Title: "The Expanse", Year: 2015}, Episode: &TraktEpisode{Season: 2, Number: 5}}},
+		// A resolution is not a season and episode
+		{"Show - 05 [1920x1080].mkv", TraktItem{Movie: &TraktMovie{Title: "Show"}}},
+		{"Movies (2010)/Inception (2010) [1920x1080].mkv", TraktItem{Movie: &TraktMovie{Title: "Inception", Year: 2010}}},
+	} {
+		// Display names carry the folders and the size, only the file name is a release name
+		file := TorrentFileInfo{DisplayName: test.path + " (1.2 GB)", Path: test.path}
+		if got := NewTraktItem(file); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %s %+v, want %s %+v", test.path, got.Name(), got, test.want.Name(), test.want)
+		}
+	}
+}
+
+func TestTraktScrobblePayload(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]map[string]interface{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("trakt-api-key") != "id" || r.Header.Get("Authorization") != "Bearer access" ||
+			r.Header.Get("trakt-api-version") != "2" {
+			t.Errorf("missing Trakt headers: %v", r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		var payload map[string]interface{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("invalid payload %s", body)
+		}
+		mu.Lock()
+		requests[r.URL.Path] = payload
+		mu.Unlock()
+		if r.URL.Path == "/scrobble/stop" {
+			// Trakt answers a repeated stop with a conflict
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client := NewTraktClient(server.URL, "id", "secret")
+	client.Token = TraktToken{AccessToken: "access"}
+
+	episode := NewTraktItem(TorrentFileInfo{DisplayName: "The.Expanse.2015.S02E05.1080p.WEB-DL.mkv (1.2 GB)", Path: "The.Expanse.2015.S02E05.1080p.WEB-DL.mkv"})
+	episode.Progress = 12.5
+	if err := client.Scrobble("start", episode); err != nil {
+		t.Fatal(err)
+	}
+	movie := NewTraktItem(TorrentFileInfo{DisplayName: "Inception (2010) [1080p].mkv (4 GB)", Path: "Inception (2010) [1080p].mkv"})
+	movie.Progress = 95
+	if err := client.Scrobble("stop", movie); err != nil {
+		t.Fatalf("a conflict should count as scrobbled: %v", err)
+	}
+
+	want := map[string]string{
+		"/scrobble/start": `{"show": {"title": "The Expanse", "year": 2015}, "episode": {"season": 2, "number": 5}, "progress": 12.5}`,
+		"/scrobble/stop":  `{"movie": {"title": "Inception", "year": 2010}, "progress": 95}`,
+	}
+	for path, body := range want {
+		var expected map[string]interface{}
+		json.Unmarshal([]byte(body), &expected)
+		if got := requests[path]; !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: got %v, want %v", path, got, expected)
+		}
+	}
+}
@@ -25,6 +25,34 @@ func IsVideoFile(filename string) bool {
     return false
 }
 
+// IsSubtitleFile reports text subtitles mpv can load on their own, VobSub .sub files need their .idx
+func IsSubtitleFile(filename string) bool {
+    subtitleExtensions := []string{
+        ".srt", ".ass", ".ssa", ".vtt",
+    }
+
+    ext := strings.ToLower(filepath.Ext(filename))
+    for _, subtitleExt := range subtitleExtensions {
+        if ext == subtitleExt {
+            return true
+        }
+    }
+    return false
+}
+
+func IsAudioFile(filename string) bool {
+    audioExtensions := []string{
+        ".mka", ".ac3", ".eac3", ".dts", ".aac", ".m4a", ".opus",
+    }
+
+    ext := strings.ToLower(filepath.Ext(filename))
+    for _, audioExt := range audioExtensions {
+        if ext == audioExt {
+            return true
+        }
+    }
+    return false
+}
 
 func UpdateButtercup(repo, fileName string) error {
     // Get the path of the currently running executable
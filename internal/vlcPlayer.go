@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// VLCPlayer runs VLC and controls it over its HTTP interface
+type VLCPlayer struct {
+	Path string
+
+	cmd      *exec.Cmd
+	baseURL  string
+	password string
+	events   chan PlayerEvent
+	exited   chan struct{}
+}
+
+// vlcStatus is the part of VLC's /requests/status.json we use
+type vlcStatus struct {
+	Time   float64 `json:"time"`
+	Length float64 `json:"length"`
+	State  string  `json:"state"`
+	Rate   float64 `json:"rate"`
+}
+
+// Start launches VLC on the stream with its HTTP interface on a free local port
+func (p *VLCPlayer) Start(streamURL string, title string) error {
+	port, err := freePort()
+	if err != nil {
+		return fmt.Errorf("failed to find a port for VLC: %w", err)
+	}
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	p.password = hex.EncodeToString(secret)
+	p.baseURL = fmt.Sprintf("http://127.0.0.1:%d", port)
+
+	path := p.Path
+	if path == "" {
+		path = "vlc"
+	}
+	p.cmd = exec.Command(path,
+		"--extraintf=http",
+		"--http-host=127.0.0.1",
+		"--http-port="+strconv.Itoa(port),
+		"--http-password="+p.password,
+		"--play-and-exit",
+		"--meta-title="+title,
+		streamURL,
+	)
+	if err := p.cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start vlc: %w", err)
+	}
+	Debug("Started vlc, HTTP interface at %s", p.baseURL)
+
+	p.exited = make(chan struct{})
+	go func() {
+		p.cmd.Wait()
+		close(p.exited)
+	}()
+
+	// Wait for the HTTP interface to come up
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		if _, err := p.status(nil); err == nil {
+			break
+		}
+		select {
+		case <-p.exited:
+			return fmt.Errorf("vlc exited before its HTTP interface was ready")
+		case <-time.After(200 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			p.cmd.Process.Kill()
+			return fmt.Errorf("timed out waiting for the vlc HTTP interface")
+		}
+	}
+
+	p.events = make(chan PlayerEvent)
+	go p.poll()
+	return nil
+}
+
+// poll turns VLC's status into property-change events until VLC exits
+func (p *VLCPlayer) poll() {
+	defer close(p.events)
+
+	var last vlcStatus
+	first := true
+	for {
+		select {
+		case <-p.exited:
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+
+		status, err := p.status(nil)
+		if err != nil {
+			continue
+		}
+		// Nothing is known about the stream until VLC has opened it
+		if status.State == "stopped" || status.Length <= 0 {
+			continue
+		}
+
+		if first || status.Length != last.Length {
+			p.emit("duration", status.Length)
+		}
+		if first || (status.State == "paused") != (last.State == "paused") {
+			p.emit("pause", status.State == "paused")
+		}
+		if first || status.Rate != last.Rate {
+			p.emit("speed", status.Rate)
+		}
+		if first || status.Time != last.Time {
+			p.emit("time-pos", status.Time)
+		}
+		last = status
+		first = false
+	}
+}
+
+func (p *VLCPlayer) emit(property string, value interface{}) {
+	select {
+	case p.events <- PlayerEvent{Name: "property-change", Property: property, Data: value}:
+	case <-p.exited:
+	}
+}
+
+// status runs an optional command and returns VLC's playback status
+func (p *VLCPlayer) status(query url.Values) (vlcStatus, error) {
+	req, err := http.NewRequest("GET", p.baseURL+"/requests/status.json?"+query.Encode(), nil)
+	if err != nil {
+		return vlcStatus{}, err
+	}
+	req.SetBasicAuth("", p.password)
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return vlcStatus{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return vlcStatus{}, fmt.Errorf("vlc returned %s", resp.Status)
+	}
+
+	var status vlcStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return vlcStatus{}, fmt.Errorf("failed to decode vlc status: %w", err)
+	}
+	return status, nil
+}
+
+func (p *VLCPlayer) command(command string, value string) error {
+	query := url.Values{"command": {command}}
+	if value != "" {
+		query.Set("val", value)
+	}
+	_, err := p.status(query)
+	return err
+}
+
+func (p *VLCPlayer) Seek(seconds int) error {
+	return p.command("seek", strconv.Itoa(seconds))
+}
+
+func (p *VLCPlayer) Position() (float64, error) {
+	status, err := p.status(nil)
+	return status.Time, err
+}
+
+func (p *VLCPlayer) Duration() (float64, error) {
+	status, err := p.status(nil)
+	return status.Length, err
+}
+
+func (p *VLCPlayer) Speed() (float64, error) {
+	status, err := p.status(nil)
+	return status.Rate, err
+}
+
+func (p *VLCPlayer) SetSpeed(speed float64) error {
+	return p.command("rate", strconv.FormatFloat(speed, 'f', -1, 64))
+}
+
+func (p *VLCPlayer) SetPaused(paused bool) error {
+	if paused {
+		return p.command("pl_forcepause", "")
+	}
+	return p.command("pl_forceresume", "")
+}
+
+// Quit closes VLC; its HTTP interface has no quit command
+func (p *VLCPlayer) Quit() error {
+	return p.cmd.Process.Kill()
+}
+
+func (p *VLCPlayer) Events() <-chan PlayerEvent {
+	return p.events
+}
+
+// freePort asks the OS for an unused TCP port
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
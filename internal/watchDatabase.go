@@ -0,0 +1,315 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// watchDatabaseMigrations upgrade the schema one version at a time, the version is kept in PRAGMA user_version.
+// Never change a released migration, add a new one instead.
+var watchDatabaseMigrations = []string{
+	// 1: shows with their settings, the torrents of each show, per-file progress and a log of watch events
+	`CREATE TABLE shows (
+		id                INTEGER PRIMARY KEY,
+		title             TEXT NOT NULL,
+		chapter_skip      TEXT NOT NULL DEFAULT '',
+		intro_start       REAL NOT NULL DEFAULT 0,
+		intro_end         REAL NOT NULL DEFAULT 0,
+		outro_start       REAL NOT NULL DEFAULT 0,
+		outro_end         REAL NOT NULL DEFAULT 0,
+		audio_language    TEXT NOT NULL DEFAULT '',
+		audio_title       TEXT NOT NULL DEFAULT '',
+		subtitle_language TEXT NOT NULL DEFAULT '',
+		subtitle_title    TEXT NOT NULL DEFAULT '',
+		subtitles_off     INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE torrents (
+		magnet_uri    TEXT PRIMARY KEY,
+		show_id       INTEGER NOT NULL REFERENCES shows(id) ON DELETE CASCADE,
+		file_index    INTEGER NOT NULL DEFAULT 0,
+		file_name     TEXT NOT NULL DEFAULT '',
+		playback_time INTEGER NOT NULL DEFAULT 0,
+		title         TEXT NOT NULL DEFAULT '',
+		episode_count INTEGER NOT NULL DEFAULT 0,
+		updated_at    INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE files (
+		magnet_uri    TEXT NOT NULL REFERENCES torrents(magnet_uri) ON DELETE CASCADE,
+		file_index    INTEGER NOT NULL,
+		playback_time INTEGER NOT NULL DEFAULT 0,
+		duration      INTEGER NOT NULL DEFAULT 0,
+		watched       INTEGER NOT NULL DEFAULT 0,
+		last_watched  INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (magnet_uri, file_index)
+	);
+	CREATE TABLE watch_events (
+		id         INTEGER PRIMARY KEY,
+		magnet_uri TEXT NOT NULL,
+		file_index INTEGER NOT NULL,
+		event      TEXT NOT NULL,
+		position   INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL
+	);
+	CREATE INDEX watch_events_file ON watch_events (magnet_uri, file_index);
+	CREATE TABLE settings (
+		key   TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`,
+	// 2: shows can be renamed and marked finished, titles copied from the first episode are dropped
+	`ALTER TABLE shows ADD COLUMN finished INTEGER NOT NULL DEFAULT 0;
+	UPDATE shows SET title = '' WHERE title IN (SELECT title FROM torrents WHERE show_id = shows.id);`,
+	// 3: AniList media linked to each show, and the progress still to be pushed to AniList
+	`ALTER TABLE shows ADD COLUMN anilist_id INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE anilist_progress (
+		media_id   INTEGER PRIMARY KEY,
+		progress   INTEGER NOT NULL,
+		status     TEXT NOT NULL,
+		updated_at INTEGER NOT NULL,
+		synced     INTEGER NOT NULL DEFAULT 0
+	);`,
+}
+
+// Watch events recorded in watch_events
+const (
+	WatchEventStarted = "started"
+	WatchEventWatched = "watched"
+)
+
+var (
+	watchDatabases   = make(map[string]*sql.DB)
+	watchDatabasesMu sync.Mutex
+)
+
+// openWatchDatabase opens the watch database once per path, migrating it and importing the old history files
+func openWatchDatabase(databaseFile string) (*sql.DB, error) {
+	watchDatabasesMu.Lock()
+	defer watchDatabasesMu.Unlock()
+
+	if db, ok := watchDatabases[databaseFile]; ok {
+		return db, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(databaseFile), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+	// Keep other instances out while backing up, migrating and importing
+	unlock, err := LockFile(databaseFile)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Several buttercup instances can share the database, wait for each other's writes
+	dsn := "file:" + databaseFile + "?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open watch database: %w", err)
+	}
+	// One connection keeps the pragmas and avoids locking ourselves out
+	db.SetMaxOpenConns(1)
+
+	if err := backupWatchDatabase(db, databaseFile); err != nil {
+		// A failed backup shouldn't keep anyone from watching
+		Debug("Error backing up watch database: %v", err)
+	}
+	if err := migrateWatchDatabase(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := importLegacyHistory(db, filepath.Dir(databaseFile)); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	watchDatabases[databaseFile] = db
+	return db, nil
+}
+
+// backupWatchDatabase keeps a copy of the database from each of the last few starts in the backups directory
+func backupWatchDatabase(db *sql.DB, databaseFile string) error {
+	keep := 5
+	if config := GetGlobalConfig(); config != nil {
+		keep = config.HistoryBackups
+	}
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	// Nothing to keep in a new database
+	if keep <= 0 || version == 0 {
+		return nil
+	}
+
+	dir := filepath.Join(filepath.Dir(databaseFile), "backups")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	prefix := strings.TrimSuffix(filepath.Base(databaseFile), filepath.Ext(databaseFile)) + "-"
+
+	// VACUUM INTO writes a consistent copy, renamed into place once complete
+	tmp := filepath.Join(dir, ".backup.tmp")
+	os.Remove(tmp)
+	if _, err := db.Exec("VACUUM INTO ?", tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, backupName(prefix, ".db"))); err != nil {
+		return err
+	}
+	return rotateBackups(dir, prefix, ".db", keep)
+}
+
+// migrateWatchDatabase applies the migrations newer than the database's schema version
+func migrateWatchDatabase(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version > len(watchDatabaseMigrations) {
+		return fmt.Errorf("the watch database is from a newer buttercup (schema %d), please update", version)
+	}
+
+	for i := version; i < len(watchDatabaseMigrations); i++ {
+		Debug("Migrating watch database to schema %d", i+1)
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(watchDatabaseMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to migrate watch database to schema %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to migrate watch database to schema %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// importLegacyHistory copies torrent_history.txt into the database once.
+// The files are left in place so older versions keep working.
+func importLegacyHistory(db *sql.DB, dir string) error {
+	var imported string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = 'legacy_history_imported'").Scan(&imported)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("failed to read database settings: %w", err)
+	}
+
+	torrents := readLegacyTorrents(filepath.Join(dir, "torrent_history.txt"))
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, torrent := range torrents {
+		if err := saveTorrent(tx, torrent); err != nil {
+			return fmt.Errorf("failed to import %s: %w", torrent.Title, err)
+		}
+	}
+	_, err = tx.Exec("INSERT INTO settings (key, value) VALUES ('legacy_history_imported', ?)", time.Now().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to import watch history: %w", err)
+	}
+
+	if len(torrents) > 0 {
+		Info("Imported %d shows from the old watch history", len(torrents))
+	}
+	return nil
+}
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// saveTorrent inserts or replaces a torrent and the settings of its show, stamped now unless UpdatedAt is set
+func saveTorrent(db sqlExecer, torrent TorrentData) error {
+	if torrent.UpdatedAt.IsZero() {
+		torrent.UpdatedAt = time.Now()
+	}
+
+	var showID int64
+	err := db.QueryRow("SELECT show_id FROM torrents WHERE magnet_uri = ?", torrent.MagnetURI).Scan(&showID)
+	if err == sql.ErrNoRows {
+		result, err := db.Exec("INSERT INTO shows (title) VALUES (?)", torrent.ShowTitle)
+		if err != nil {
+			return err
+		}
+		if showID, err = result.LastInsertId(); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`UPDATE shows SET title = ?, finished = ?, anilist_id = ?, chapter_skip = ?, intro_start = ?, intro_end = ?, outro_start = ?, outro_end = ?,
+		audio_language = ?, audio_title = ?, subtitle_language = ?, subtitle_title = ?, subtitles_off = ? WHERE id = ?`,
+		torrent.ShowTitle, torrent.Finished, torrent.AnilistID, torrent.ChapterSkip, torrent.Intro.Start, torrent.Intro.End, torrent.Outro.Start, torrent.Outro.End,
+		torrent.AudioTrack.Language, torrent.AudioTrack.Title,
+		torrent.SubtitleTrack.Language, torrent.SubtitleTrack.Title, torrent.SubtitleTrack.Off, showID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`INSERT INTO torrents (magnet_uri, show_id, file_index, file_name, playback_time, title, episode_count, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (magnet_uri) DO UPDATE SET file_index = excluded.file_index, file_name = excluded.file_name,
+			playback_time = excluded.playback_time, title = excluded.title, episode_count = excluded.episode_count,
+			updated_at = excluded.updated_at`,
+		torrent.MagnetURI, showID, torrent.FileIndex, torrent.FileName, torrent.PlaybackTime, torrent.Title,
+		torrent.EpisodeCount, torrent.UpdatedAt.Unix())
+	return err
+}
+
+// saveEpisode inserts or replaces the progress of an episode, logging when it starts and when it gets watched
+func saveEpisode(db sqlExecer, episode EpisodeProgress) error {
+	var watched bool
+	err := db.QueryRow("SELECT watched FROM files WHERE magnet_uri = ? AND file_index = ?",
+		episode.MagnetURI, episode.FileIndex).Scan(&watched)
+	isNew := err == sql.ErrNoRows
+	if err != nil && !isNew {
+		return err
+	}
+
+	_, err = db.Exec(`INSERT INTO files (magnet_uri, file_index, playback_time, duration, watched, last_watched)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (magnet_uri, file_index) DO UPDATE SET playback_time = excluded.playback_time,
+			duration = excluded.duration, watched = excluded.watched, last_watched = excluded.last_watched`,
+		episode.MagnetURI, episode.FileIndex, episode.PlaybackTime, episode.Duration, episode.Watched, episode.LastWatched.Unix())
+	if err != nil {
+		return err
+	}
+
+	event := ""
+	switch {
+	case episode.Watched && !watched:
+		event = WatchEventWatched
+	case isNew:
+		event = WatchEventStarted
+	}
+	if event == "" {
+		return nil
+	}
+	_, err = db.Exec("INSERT INTO watch_events (magnet_uri, file_index, event, position, created_at) VALUES (?, ?, ?, ?, ?)",
+		episode.MagnetURI, episode.FileIndex, event, episode.PlaybackTime, episode.LastWatched.Unix())
+	return err
+}
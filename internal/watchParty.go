@@ -0,0 +1,418 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// usingHostStream is set when a guest plays the stream of a host on the same machine,
+// whose webtorrent must survive the guest exiting
+var usingHostStream bool
+
+// PartyMessage is a line of JSON exchanged between watch party members
+type PartyMessage struct {
+	Type      string  `json:"type"`             // "host", "join", "denied", "episode" or "state"
+	Secret    string  `json:"secret,omitempty"` // Sent with "host" and "join", the hub turns away members without it
+	MagnetURI string  `json:"magnet_uri,omitempty"`
+	FileIndex int     `json:"file_index"`
+	Title     string  `json:"title,omitempty"`
+	StreamURL string  `json:"stream_url,omitempty"` // The host's local stream, for guests on the same machine
+	Position  float64 `json:"position"`
+	Paused    bool    `json:"paused"`
+	Speed     float64 `json:"speed"`
+}
+
+// PartyPublisher sends the host's episode and playback state to the guests
+type PartyPublisher interface {
+	Publish(msg PartyMessage)
+}
+
+func writePartyMessage(conn net.Conn, msg PartyMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write(append(data, '\n'))
+	return err
+}
+
+// checkPartySecret refuses to run a watch party that anyone could connect to
+func checkPartySecret(secret string) error {
+	if secret == "" {
+		return fmt.Errorf("a watch party secret is required")
+	}
+	return nil
+}
+
+// partyGuestBuffer is how many messages a guest may fall behind before it is dropped
+const partyGuestBuffer = 16
+
+// PartyHub relays the host's messages to every guest and replays the latest ones to late joiners.
+// It runs inside the host's buttercup, or on its own as a relay that hosts connect to.
+type PartyHub struct {
+	listener net.Listener
+	secret   string
+	relay    bool
+
+	mu      sync.Mutex
+	guests  map[net.Conn]chan PartyMessage
+	episode *PartyMessage
+	state   *PartyMessage
+}
+
+// StartPartyHub listens for watch party members on addr (e.g. ":7000"), who need to know secret to join.
+// Only a relay accepts a host, a hub inside the host's buttercup takes guests alone.
+func StartPartyHub(addr string, secret string, relay bool) (*PartyHub, error) {
+	if err := checkPartySecret(secret); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	hub := &PartyHub{
+		listener: listener,
+		secret:   secret,
+		relay:    relay,
+		guests:   make(map[net.Conn]chan PartyMessage),
+	}
+	go hub.accept()
+	return hub, nil
+}
+
+// Addr returns the address the hub listens on
+func (h *PartyHub) Addr() string {
+	return h.listener.Addr().String()
+}
+
+func (h *PartyHub) accept() {
+	for {
+		conn, err := h.listener.Accept()
+		if err != nil {
+			return
+		}
+		go h.handle(conn)
+	}
+}
+
+// handle serves one member, which says whether it hosts or joins in its first message
+func (h *PartyHub) handle(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		return
+	}
+	var hello PartyMessage
+	if err := json.Unmarshal(scanner.Bytes(), &hello); err != nil {
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(hello.Secret), []byte(h.secret)) != 1 {
+		Debug("Turning away watch party member %s with the wrong secret", conn.RemoteAddr())
+		writePartyMessage(conn, PartyMessage{Type: "denied"})
+		return
+	}
+
+	switch hello.Type {
+	case "host":
+		if !h.relay {
+			Debug("Turning away watch party host %s, the party already has one", conn.RemoteAddr())
+			writePartyMessage(conn, PartyMessage{Type: "denied"})
+			return
+		}
+		Debug("Watch party host connected from %s", conn.RemoteAddr())
+		for scanner.Scan() {
+			var msg PartyMessage
+			if err := json.Unmarshal(scanner.Bytes(), &msg); err == nil {
+				h.Publish(msg)
+			}
+		}
+	case "join":
+		Debug("Watch party guest joined from %s", conn.RemoteAddr())
+		send := make(chan PartyMessage, partyGuestBuffer)
+		h.mu.Lock()
+		for _, msg := range []*PartyMessage{h.episode, h.state} {
+			if msg != nil {
+				send <- *msg
+			}
+		}
+		h.guests[conn] = send
+		h.mu.Unlock()
+		go h.write(conn, send)
+
+		// Guests don't send anything else, wait for them to leave
+		for scanner.Scan() {
+		}
+		h.mu.Lock()
+		h.dropGuest(conn)
+		h.mu.Unlock()
+		Debug("Watch party guest %s left", conn.RemoteAddr())
+	}
+}
+
+// write sends the messages queued for a guest until it is dropped
+func (h *PartyHub) write(conn net.Conn, send chan PartyMessage) {
+	for msg := range send {
+		if err := writePartyMessage(conn, msg); err != nil {
+			Debug("Dropping watch party guest %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+}
+
+// dropGuest disconnects a guest, h.mu must be held
+func (h *PartyHub) dropGuest(conn net.Conn) {
+	if send, ok := h.guests[conn]; ok {
+		close(send)
+		conn.Close()
+		delete(h.guests, conn)
+	}
+}
+
+// Publish queues a message for every guest without waiting for them, dropping guests that fell too far behind
+func (h *PartyHub) Publish(msg PartyMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch msg.Type {
+	case "episode":
+		h.episode = &msg
+		h.state = nil
+	case "state":
+		h.state = &msg
+	}
+	for conn, send := range h.guests {
+		select {
+		case send <- msg:
+		default:
+			Debug("Dropping watch party guest %s, it is not keeping up", conn.RemoteAddr())
+			h.dropGuest(conn)
+		}
+	}
+}
+
+// Close stops the hub and disconnects everyone
+func (h *PartyHub) Close() {
+	h.listener.Close()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for conn := range h.guests {
+		h.dropGuest(conn)
+	}
+}
+
+// PartyRelayHost hosts a watch party through a hub running elsewhere
+type PartyRelayHost struct {
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+// ConnectPartyRelay connects to a relay as the host
+func ConnectPartyRelay(addr string, secret string) (*PartyRelayHost, error) {
+	if err := checkPartySecret(secret); err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to relay: %w", err)
+	}
+	if err := writePartyMessage(conn, PartyMessage{Type: "host", Secret: secret}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			var msg PartyMessage
+			if json.Unmarshal(scanner.Bytes(), &msg) == nil && msg.Type == "denied" {
+				Info("The watch party relay turned us away, check the secret and that it runs with -party-relay")
+			}
+		}
+	}()
+	return &PartyRelayHost{conn: conn}, nil
+}
+
+// Publish sends a message to the relay
+func (r *PartyRelayHost) Publish(msg PartyMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := writePartyMessage(r.conn, msg); err != nil {
+		Debug("Error sending to watch party relay: %v", err)
+	}
+}
+
+// PartyGuest follows the playback of a watch party host
+type PartyGuest struct {
+	conn      net.Conn
+	local     bool
+	tolerance float64
+	messages  chan PartyMessage
+	switches  chan PartyMessage
+
+	mu        sync.Mutex
+	episode   PartyMessage
+	player    Player
+	fileIndex int
+}
+
+// JoinWatchParty connects to a host or relay with the party's secret.
+// The local player is kept within tolerance seconds of the host.
+func JoinWatchParty(addr string, secret string, tolerance float64) (*PartyGuest, error) {
+	if err := checkPartySecret(secret); err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join watch party: %w", err)
+	}
+	if err := writePartyMessage(conn, PartyMessage{Type: "join", Secret: secret}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	guest := &PartyGuest{
+		conn:      conn,
+		local:     conn.RemoteAddr().(*net.TCPAddr).IP.IsLoopback(),
+		tolerance: tolerance,
+		messages:  make(chan PartyMessage, 16),
+		switches:  make(chan PartyMessage, 1),
+		fileIndex: -1,
+	}
+	go guest.read()
+	return guest, nil
+}
+
+func (g *PartyGuest) read() {
+	defer close(g.messages)
+	scanner := bufio.NewScanner(g.conn)
+	for scanner.Scan() {
+		var msg PartyMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err == nil {
+			g.messages <- msg
+		}
+	}
+}
+
+// WaitEpisode waits for the host to say what it is playing
+func (g *PartyGuest) WaitEpisode() (PartyMessage, error) {
+	for msg := range g.messages {
+		switch msg.Type {
+		case "denied":
+			return PartyMessage{}, fmt.Errorf("wrong watch party secret")
+		case "episode":
+			g.episode = msg
+			return msg, nil
+		}
+	}
+	return PartyMessage{}, fmt.Errorf("the host left before starting an episode")
+}
+
+// Follow keeps a player in step with the host. When the host moves to another episode
+// the player is closed and the episode is delivered on Switches.
+func (g *PartyGuest) Follow(player Player, fileIndex int) {
+	g.mu.Lock()
+	started := g.fileIndex >= 0
+	g.player = player
+	g.fileIndex = fileIndex
+	g.mu.Unlock()
+
+	if !started {
+		go g.sync()
+	}
+}
+
+// Switches delivers the episodes the host moves to, and is closed when the host leaves
+func (g *PartyGuest) Switches() <-chan PartyMessage {
+	return g.switches
+}
+
+func (g *PartyGuest) sync() {
+	defer close(g.switches)
+	for msg := range g.messages {
+		g.mu.Lock()
+		switch msg.Type {
+		case "episode":
+			g.episode = msg
+			if msg.FileIndex != g.fileIndex {
+				Debug("Watch party host switched to %s", msg.Title)
+				// Keep only the latest switch
+				select {
+				case <-g.switches:
+				default:
+				}
+				g.switches <- msg
+				g.player.Quit()
+			}
+		case "state":
+			if msg.FileIndex == g.fileIndex {
+				syncPlayer(g.player, msg, g.tolerance)
+			}
+		}
+		g.mu.Unlock()
+	}
+	Info("The watch party host has left")
+}
+
+// syncPlayer matches the host's speed and pause state and seeks when the position drifted too far
+func syncPlayer(player Player, msg PartyMessage, tolerance float64) {
+	if msg.Speed > 0 {
+		if speed, err := player.Speed(); err == nil && speed != msg.Speed {
+			player.SetSpeed(msg.Speed)
+		}
+	}
+	if err := player.SetPaused(msg.Paused); err != nil {
+		return
+	}
+
+	position, err := player.Position()
+	if err != nil {
+		return
+	}
+	if drift := position - msg.Position; math.Abs(drift) > tolerance {
+		Debug("Watch party drift of %.1fs, seeking to %.1f", drift, msg.Position)
+		player.Seek(int(msg.Position + 0.5))
+	}
+}
+
+// SharesHostStream reports whether the host runs on this machine and its stream can be played directly,
+// which avoids a second webtorrent fighting over the same port
+func (g *PartyGuest) SharesHostStream() bool {
+	g.mu.Lock()
+	streamURL := g.episode.StreamURL
+	g.mu.Unlock()
+	if !g.local || streamURL == "" {
+		return false
+	}
+
+	client := http.Client{Timeout: 5 * time.Second}
+	req, err := http.NewRequest("GET", streamURL, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 300
+}
+
+// PlayHostStream opens the stream of a host on the same machine in the configured player
+func (g *PartyGuest) PlayHostStream(title string) (Player, error) {
+	g.mu.Lock()
+	streamURL := g.episode.StreamURL
+	g.mu.Unlock()
+
+	usingHostStream = true
+	return PlayStream(streamURL, title)
+}
@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func nextPartyMessage(t *testing.T, guest *PartyGuest) PartyMessage {
+	t.Helper()
+	select {
+	case msg, ok := <-guest.messages:
+		if !ok {
+			t.Fatal("the guest was disconnected")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a watch party message")
+	}
+	return PartyMessage{}
+}
+
+func TestWatchParty(t *testing.T) {
+	hub, err := StartPartyHub("127.0.0.1:0", "secret", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+
+	// Guests joining late get the episode and position the host is at
+	episode := PartyMessage{Type: "episode", MagnetURI: "magnet:?xt=urn:btih:abc", FileIndex: 3, Title: "Show S01E04"}
+	hub.Publish(episode)
+	hub.Publish(PartyMessage{Type: "state", FileIndex: 3, Position: 42, Speed: 1})
+
+	guest, err := JoinWatchParty(hub.Addr(), "secret", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := guest.WaitEpisode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.MagnetURI != episode.MagnetURI || got.FileIndex != episode.FileIndex || got.Title != episode.Title {
+		t.Errorf("got episode %+v, want %+v", got, episode)
+	}
+	if state := nextPartyMessage(t, guest); state.Type != "state" || state.Position != 42 {
+		t.Errorf("got %+v, want the replayed state at 42s", state)
+	}
+
+	// A host connected through the hub as a relay reaches the guest
+	relay, err := ConnectPartyRelay(hub.Addr(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.Publish(PartyMessage{Type: "state", FileIndex: 3, Position: 60, Paused: true, Speed: 1.5})
+	if state := nextPartyMessage(t, guest); state.Position != 60 || !state.Paused || state.Speed != 1.5 {
+		t.Errorf("got %+v, want the relayed state at 60s", state)
+	}
+}
+
+func TestWatchPartyWrongSecret(t *testing.T) {
+	hub, err := StartPartyHub("127.0.0.1:0", "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	hub.Publish(PartyMessage{Type: "episode", FileIndex: 0, Title: "Show S01E01"})
+
+	guest, err := JoinWatchParty(hub.Addr(), "guess", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := guest.WaitEpisode(); err == nil {
+		t.Error("joined with the wrong secret")
+	}
+}
+
+func TestWatchPartyRequiresSecret(t *testing.T) {
+	if hub, err := StartPartyHub("127.0.0.1:0", "", true); err == nil {
+		hub.Close()
+		t.Error("started a hub without a secret")
+	}
+	if _, err := ConnectPartyRelay("127.0.0.1:0", ""); err == nil {
+		t.Error("hosted through a relay without a secret")
+	}
+	if _, err := JoinWatchParty("127.0.0.1:0", "", 2); err == nil {
+		t.Error("joined without a secret")
+	}
+}
+
+func TestWatchPartyHostTakeover(t *testing.T) {
+	hub, err := StartPartyHub("127.0.0.1:0", "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+
+	// A member of a hosted party that knows the secret can't start publishing episodes
+	conn, err := net.Dial("tcp", hub.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := writePartyMessage(conn, PartyMessage{Type: "host", Secret: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	writePartyMessage(conn, PartyMessage{Type: "episode", MagnetURI: "magnet:?xt=urn:btih:evil", Title: "Something else"})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		t.Fatalf("the hub closed the connection without an answer: %v", scanner.Err())
+	}
+	var reply PartyMessage
+	if err := json.Unmarshal(scanner.Bytes(), &reply); err != nil || reply.Type != "denied" {
+		t.Errorf("got %s, want the host to be denied", scanner.Bytes())
+	}
+	if scanner.Scan() {
+		t.Errorf("the hub kept talking to the denied host: %s", scanner.Bytes())
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.episode != nil {
+		t.Errorf("the denied host published %+v", *hub.episode)
+	}
+}
+
+func TestWatchPartyPublishDoesNotBlock(t *testing.T) {
+	hub, err := StartPartyHub("127.0.0.1:0", "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+
+	// A guest that never reads its messages must not hold up the host
+	guest, err := JoinWatchParty(hub.Addr(), "secret", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer guest.conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		hub.mu.Lock()
+		joined := len(hub.guests) == 1
+		hub.mu.Unlock()
+		if joined {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the guest never joined")
+		}
+	}
+
+	title := string(make([]byte, 64*1024))
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			hub.Publish(PartyMessage{Type: "state", Title: title})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Publish blocked on a slow guest")
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if len(hub.guests) != 0 {
+		t.Error("the lagging guest was not dropped")
+	}
+}